@@ -0,0 +1,45 @@
+package apkg
+
+import (
+	"sort"
+
+	"github.com/innatical/apkg/v2/util"
+)
+
+// Changes lists the packages an operation installed, upgraded or removed,
+// worked out by comparing the database before and after it ran. Packages are
+// sorted by name and listed without their files.
+type Changes struct {
+	Installed []util.DBPackage `toml:"installed" json:"installed"`
+	Upgraded  []util.DBPackage `toml:"upgraded" json:"upgraded"`
+	Removed   []util.DBPackage `toml:"removed" json:"removed"`
+}
+
+func diffPackages(before map[string]util.DBPackage, after map[string]util.DBPackage) *Changes {
+	changes := &Changes{Installed: []util.DBPackage{}, Upgraded: []util.DBPackage{}, Removed: []util.DBPackage{}}
+
+	for name, pkg := range after {
+		pkg.Files = nil
+
+		if old, ok := before[name]; !ok {
+			changes.Installed = append(changes.Installed, pkg)
+		} else if old.Hash != pkg.Hash {
+			changes.Upgraded = append(changes.Upgraded, pkg)
+		}
+	}
+
+	for name, pkg := range before {
+		if _, ok := after[name]; !ok {
+			pkg.Files = nil
+			changes.Removed = append(changes.Removed, pkg)
+		}
+	}
+
+	for _, list := range [][]util.DBPackage{changes.Installed, changes.Upgraded, changes.Removed} {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Package.Name < list[j].Package.Name
+		})
+	}
+
+	return changes
+}
@@ -0,0 +1,586 @@
+// Package apkg is the library interface to the apkg package manager. A
+// Manager manages one root; every operation takes a context that can cancel
+// it, and the database is locked for the duration of each operation, so a
+// Manager can be shared between goroutines and several roots can be managed
+// from one process.
+package apkg
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/innatical/apkg/v2/util"
+)
+
+// Options configures a Manager. Only Root is required.
+type Options struct {
+	// Root is the directory packages are installed into.
+	Root string
+
+	// Stdin, Stdout and Stderr are the standard streams hooks run with.
+	// They default to the process's own.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Hooks decides whether package hooks run. It defaults to HooksRun.
+	Hooks util.HookPolicy
+
+	// Logger receives warnings. It defaults to a logger on Stderr.
+	Logger *log.Logger
+
+	// Signatures is the signature policy for installed packages. It
+	// defaults to SignatureWarn.
+	Signatures util.SignaturePolicy
+
+	// Extract limits what package archives may contain.
+	Extract util.ExtractOptions
+
+	// Wait is how long to wait for other processes to release the database:
+	// zero fails immediately, a negative wait waits until the context is
+	// cancelled.
+	Wait time.Duration
+}
+
+type Manager struct {
+	env     util.Env
+	install util.InstallOptions
+	wait    time.Duration
+
+	// lock serializes the operations of goroutines sharing the Manager,
+	// which the database lock alone would turn into LockedErrors.
+	lock sync.RWMutex
+}
+
+// New creates a Manager for the root in options, creating the root if it
+// doesn't exist yet.
+func New(options Options) (*Manager, error) {
+	if options.Root == "" {
+		return nil, &util.ErrorString{S: "No root given"}
+	}
+
+	if options.Hooks == "" {
+		options.Hooks = util.HooksRun
+	} else if _, err := util.ParseHookPolicy(string(options.Hooks)); err != nil {
+		return nil, err
+	}
+
+	if options.Signatures == "" {
+		options.Signatures = util.SignatureWarn
+	} else if _, err := util.ParseSignaturePolicy(string(options.Signatures)); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(options.Root, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Manager{
+		env: util.Env{
+			Root:   options.Root,
+			Stdin:  options.Stdin,
+			Stdout: options.Stdout,
+			Stderr: options.Stderr,
+			Hooks:  options.Hooks,
+			Logger: options.Logger,
+		},
+		install: util.InstallOptions{Signatures: options.Signatures, Extract: options.Extract},
+		wait:    options.Wait,
+	}, nil
+}
+
+// Root returns the directory the Manager manages.
+func (m *Manager) Root() string {
+	return m.env.Root
+}
+
+// read runs fn with the database locked for reading.
+func (m *Manager) read(ctx context.Context, fn func(env *util.Env) error) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.locked(ctx, false, fn)
+}
+
+// write runs fn with the database locked exclusively.
+func (m *Manager) write(ctx context.Context, fn func(env *util.Env) error) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.locked(ctx, true, fn)
+}
+
+// locked takes the database lock and runs fn under ctx. Nothing is run once
+// ctx has been cancelled.
+func (m *Manager) locked(ctx context.Context, exclusive bool, fn func(env *util.Env) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	env := m.env.WithContext(ctx)
+
+	lock, err := util.LockDatabase(env, exclusive, m.wait)
+	if err != nil {
+		return err
+	}
+
+	defer lock.Unlock()
+
+	return fn(env)
+}
+
+// change runs a mutating operation and returns the packages it changed.
+func (m *Manager) change(ctx context.Context, fn func(env *util.Env) error) (*Changes, error) {
+	var changes *Changes
+
+	err := m.write(ctx, func(env *util.Env) error {
+		before, err := util.ListInstalled(env)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(env); err != nil {
+			return err
+		}
+
+		after, err := util.ListInstalled(env)
+		if err != nil {
+			return err
+		}
+
+		changes = diffPackages(before, after)
+
+		return nil
+	})
+
+	return changes, err
+}
+
+// splitTargets separates the package archives among targets from the names
+// of packages to fetch from the repositories. A target is an archive when a
+// file exists at that path.
+func splitTargets(targets []string) ([]string, []string, error) {
+	var files []string
+	var names []string
+
+	for _, target := range targets {
+		if _, err := os.Stat(target); err == nil {
+			files = append(files, target)
+		} else if os.IsNotExist(err) {
+			names = append(names, target)
+		} else {
+			return nil, nil, err
+		}
+	}
+
+	return files, names, nil
+}
+
+// fetch downloads the named packages and every dependency of them and of the
+// local archives that isn't installed yet. It returns all the archives to
+// install, and the names of the packages targets asked for. Local archives
+// are only read up to their package.toml, which comes first, here; the one
+// full read of each is when it is extracted.
+func (m *Manager) fetch(env *util.Env, targets []string) ([]string, []string, error) {
+	files, names, err := splitTargets(targets)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	requested := make([]string, 0, len(targets))
+	local := make([]util.Candidate, 0, len(files))
+
+	for _, file := range files {
+		pkg, err := util.InspectPackage(file)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		requested = append(requested, pkg.Package.Name)
+		local = append(local, util.CandidateFromPackage(pkg, file))
+	}
+
+	for _, target := range names {
+		name, _ := util.SplitDependency(target)
+		requested = append(requested, name)
+	}
+
+	downloaded, err := util.FetchPackages(env, local, names)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append(files, downloaded...), requested, nil
+}
+
+// Install installs packages and their dependencies. Targets are package
+// archives, or names of packages in the configured repositories, optionally
+// with a version constraint as in name@^1.2. The targets are recorded as
+// installed explicitly, the packages pulled in for them as dependencies.
+func (m *Manager) Install(ctx context.Context, targets []string) (*Changes, error) {
+	return m.change(ctx, func(env *util.Env) error {
+		files, requested, err := m.fetch(env, targets)
+		if err != nil {
+			return err
+		}
+
+		return util.InstallMultiple(env, files, requested, m.install)
+	})
+}
+
+// PlanInstall works out what Install would do with targets without changing
+// the root. It only reads the database, and resolves packages from the
+// repository indexes without downloading them.
+func (m *Manager) PlanInstall(ctx context.Context, targets []string) (*util.Plan, error) {
+	var plan *util.Plan
+
+	err := m.read(ctx, func(env *util.Env) error {
+		files, names, err := splitTargets(targets)
+		if err != nil {
+			return err
+		}
+
+		plan, err = util.PlanInstall(env, files, names, m.install)
+
+		return err
+	})
+
+	return plan, err
+}
+
+// Upgrade upgrades installed packages. Targets are package archives, or
+// names of installed packages to upgrade to the newest version in the
+// repositories; without targets every installed package is upgraded. New
+// dependencies are installed and every package upgraded in one transaction,
+// each after the packages it depends on.
+func (m *Manager) Upgrade(ctx context.Context, targets []string) (*Changes, error) {
+	return m.change(ctx, func(env *util.Env) error {
+		files, names, err := splitTargets(targets)
+		if err != nil {
+			return err
+		}
+
+		var dependencies []string
+
+		if len(files) == 0 || len(names) != 0 {
+			var upgrades []string
+
+			dependencies, upgrades, err = util.FetchUpgrades(env, names)
+			if err != nil {
+				return err
+			}
+
+			files = append(files, upgrades...)
+		}
+
+		if len(dependencies) == 0 && len(files) == 0 {
+			return nil
+		}
+
+		return util.UpgradeMultiple(env, dependencies, files, m.install)
+	})
+}
+
+// RemoveOptions controls which packages Remove removes.
+type RemoveOptions struct {
+	// Recursive also removes every installed package that requires one of
+	// the named packages, directly or through other packages.
+	Recursive bool
+
+	// Confirm, when set, is called with every package about to be removed,
+	// in the order they will be removed in, before anything is changed.
+	// Returning an error cancels the removal.
+	Confirm func(names []string) error
+}
+
+// Remove removes installed packages in one transaction, dependents before
+// the packages they depend on.
+func (m *Manager) Remove(ctx context.Context, names []string, options RemoveOptions) (*Changes, error) {
+	return m.change(ctx, func(env *util.Env) error {
+		order, err := util.RemovalOrder(env, names, options.Recursive)
+		if err != nil {
+			return err
+		}
+
+		if options.Confirm != nil {
+			if err := options.Confirm(order); err != nil {
+				return err
+			}
+		}
+
+		return util.RemoveMultiple(env, order)
+	})
+}
+
+// PlanRemove works out what Remove would do without changing the root.
+func (m *Manager) PlanRemove(ctx context.Context, names []string, options RemoveOptions) (*util.Plan, error) {
+	var plan *util.Plan
+
+	err := m.read(ctx, func(env *util.Env) error {
+		order, err := util.RemovalOrder(env, names, options.Recursive)
+		if err != nil {
+			return err
+		}
+
+		plan, err = util.PlanRemove(env, order)
+
+		return err
+	})
+
+	return plan, err
+}
+
+// Autoremove removes the packages that were installed as dependencies and
+// that no explicitly installed package requires any more.
+func (m *Manager) Autoremove(ctx context.Context) (*Changes, error) {
+	return m.change(ctx, func(env *util.Env) error {
+		orphans, err := util.FindOrphans(env)
+		if err != nil || len(orphans) == 0 {
+			return err
+		}
+
+		return util.RemoveMultiple(env, orphans)
+	})
+}
+
+// PlanAutoremove works out what Autoremove would do without changing the
+// root.
+func (m *Manager) PlanAutoremove(ctx context.Context) (*util.Plan, error) {
+	var plan *util.Plan
+
+	err := m.read(ctx, func(env *util.Env) error {
+		orphans, err := util.FindOrphans(env)
+		if err != nil {
+			return err
+		}
+
+		plan, err = util.PlanRemove(env, orphans)
+
+		return err
+	})
+
+	return plan, err
+}
+
+// Mark records why the named packages are installed: util.ReasonExplicit
+// keeps them from being autoremoved, util.ReasonDependency lets Autoremove
+// remove them once nothing explicitly installed requires them.
+func (m *Manager) Mark(ctx context.Context, names []string, reason string) error {
+	return m.write(ctx, func(env *util.Env) error {
+		return util.MarkPackages(env, names, reason)
+	})
+}
+
+// List returns the installed packages sorted by name, without their files.
+func (m *Manager) List(ctx context.Context) ([]util.DBPackage, error) {
+	var packages []util.DBPackage
+
+	err := m.read(ctx, func(env *util.Env) error {
+		installed, err := util.ListInstalled(env)
+		if err != nil {
+			return err
+		}
+
+		packages = sortPackages(installed)
+
+		return nil
+	})
+
+	return packages, err
+}
+
+// Info returns the package.toml of an installed package.
+func (m *Manager) Info(ctx context.Context, name string) (*util.PackageRoot, error) {
+	var pkg *util.PackageRoot
+
+	err := m.read(ctx, func(env *util.Env) (err error) {
+		pkg, err = util.PackageInfo(env, name)
+		return err
+	})
+
+	return pkg, err
+}
+
+// OptionalStatus checks the optional dependencies of pkg, installed or not,
+// against the installed packages.
+func (m *Manager) OptionalStatus(ctx context.Context, pkg *util.PackageRoot) ([]util.OptionalDependency, error) {
+	var optional []util.OptionalDependency
+
+	err := m.read(ctx, func(env *util.Env) (err error) {
+		optional, err = util.OptionalStatus(env, pkg)
+		return err
+	})
+
+	return optional, err
+}
+
+// Why explains why an installed package is installed and what removing it
+// would take with it.
+func (m *Manager) Why(ctx context.Context, name string) (*util.WhyResult, error) {
+	var result *util.WhyResult
+
+	err := m.read(ctx, func(env *util.Env) (err error) {
+		result, err = util.Why(env, name)
+		return err
+	})
+
+	return result, err
+}
+
+// Graph builds the dependency graph of the installed packages or, when files
+// are given, of those package archives and the installed packages they
+// depend on.
+func (m *Manager) Graph(ctx context.Context, files []string) (*util.DependencyGraph, error) {
+	var graph *util.DependencyGraph
+
+	err := m.read(ctx, func(env *util.Env) (err error) {
+		graph, err = util.BuildGraph(env, files)
+		return err
+	})
+
+	return graph, err
+}
+
+// Owns returns the names of the installed packages that placed path in the
+// root. Relative paths are taken relative to the root unless they point into
+// it from the working directory.
+func (m *Manager) Owns(ctx context.Context, path string) ([]string, error) {
+	var owners []string
+
+	err := m.read(ctx, func(env *util.Env) (err error) {
+		owners, err = util.FindOwners(env, path)
+		return err
+	})
+
+	return owners, err
+}
+
+// Files returns the files an installed package placed in the root.
+func (m *Manager) Files(ctx context.Context, name string) ([]util.DBFile, error) {
+	var files []util.DBFile
+
+	err := m.read(ctx, func(env *util.Env) (err error) {
+		files, err = util.PackageFiles(env, name)
+		return err
+	})
+
+	if files == nil && err == nil {
+		files = []util.DBFile{}
+	}
+
+	return files, err
+}
+
+// Verify checks the files of the named packages, or of every installed
+// package when names is empty, and returns those that no longer match the
+// package store.
+func (m *Manager) Verify(ctx context.Context, names []string) ([]util.VerifyResult, error) {
+	var results []util.VerifyResult
+
+	err := m.read(ctx, func(env *util.Env) (err error) {
+		results, err = util.Verify(env, names)
+		return err
+	})
+
+	return results, err
+}
+
+// Repair relinks the files of the named packages, or of every installed
+// package when names is empty, that no longer match the package store, and
+// returns what it repaired. With runHooks the postinstall hook of every
+// repaired package runs again.
+func (m *Manager) Repair(ctx context.Context, names []string, runHooks bool) ([]util.VerifyResult, error) {
+	var repaired []util.VerifyResult
+
+	err := m.write(ctx, func(env *util.Env) (err error) {
+		repaired, err = util.Repair(env, names, runHooks)
+		return err
+	})
+
+	return repaired, err
+}
+
+// Keys returns the keys trusted to sign packages, sorted by name.
+func (m *Manager) Keys(ctx context.Context) ([]util.Key, error) {
+	var keys []util.Key
+
+	err := m.read(ctx, func(env *util.Env) (err error) {
+		keys, err = util.ListKeys(env.Root)
+		return err
+	})
+
+	return keys, err
+}
+
+// AddKey trusts the public key at path under name.
+func (m *Manager) AddKey(ctx context.Context, name string, path string) (*util.Key, error) {
+	var key *util.Key
+
+	err := m.write(ctx, func(env *util.Env) (err error) {
+		key, err = util.AddKey(env.Root, name, path)
+		return err
+	})
+
+	return key, err
+}
+
+// RemoveKey stops trusting the key with the given name.
+func (m *Manager) RemoveKey(ctx context.Context, name string) error {
+	return m.write(ctx, func(env *util.Env) error {
+		return util.RemoveKey(env.Root, name)
+	})
+}
+
+// Repositories returns the configured package repositories.
+func (m *Manager) Repositories(ctx context.Context) ([]util.Repository, error) {
+	var repositories []util.Repository
+
+	err := m.read(ctx, func(env *util.Env) error {
+		config, err := util.ReadRepositories(env.Root)
+		if err != nil {
+			return err
+		}
+
+		repositories = config.Repositories
+		return nil
+	})
+
+	return repositories, err
+}
+
+// AddRepository adds a package repository. URLs may be http(s), file:// or
+// a plain directory path.
+func (m *Manager) AddRepository(ctx context.Context, name string, url string) error {
+	return m.write(ctx, func(env *util.Env) error {
+		return util.AddRepository(env.Root, name, url)
+	})
+}
+
+// RemoveRepository removes the package repository with the given name.
+func (m *Manager) RemoveRepository(ctx context.Context, name string) error {
+	return m.write(ctx, func(env *util.Env) error {
+		return util.RemoveRepository(env.Root, name)
+	})
+}
+
+// sortPackages returns the packages in installed sorted by name, without
+// their files.
+func sortPackages(installed map[string]util.DBPackage) []util.DBPackage {
+	packages := make([]util.DBPackage, 0, len(installed))
+
+	for _, pkg := range installed {
+		pkg.Files = nil
+		packages = append(packages, pkg)
+	}
+
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].Package.Name < packages[j].Package.Name
+	})
+
+	return packages
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"path/filepath"
+
+	"github.com/innatical/apkg/v2/util"
+	"github.com/urfave/cli/v2"
+)
+
+type buildOutput struct {
+	Name      string          `toml:"name" json:"name"`
+	Version   string          `toml:"version" json:"version"`
+	Output    string          `toml:"output" json:"output"`
+	Signature *util.Signature `toml:"signature,omitempty" json:"signature,omitempty"`
+}
+
+func Build(c *cli.Context) error {
+	source := c.Args().First()
+	if source == "" {
+		source = "."
+	}
+
+	output := c.String("output")
+	if output == "" {
+		pkg, err := util.ParsePackageFile(filepath.Join(source, "package.toml"))
+		if err != nil {
+			return err
+		}
+
+		output = pkg.Package.Name + "-" + pkg.Package.Version + ".apkg"
+	}
+
+	pkg, err := util.BuildPackage(source, output)
+	if err != nil {
+		return err
+	}
+
+	result := buildOutput{Name: pkg.Package.Name, Version: pkg.Package.Version, Output: output}
+
+	if key := c.String("sign"); key != "" {
+		result.Signature, err = util.SignPackage(output, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeOutput(c, result, func() {
+		println("Built " + pkg.Package.Name + "@" + pkg.Package.Version + " to " + output)
+
+		if result.Signature != nil {
+			println("Signed with key " + result.Signature.Key + " to " + output + util.SignatureSuffix)
+		}
+	})
+}
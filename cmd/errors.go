@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+
+	"github.com/innatical/apkg/v2/util"
+)
+
+// Exit statuses apkg exits with, by the kind of error a command failed with.
+const (
+	ExitError            = 1
+	ExitNotFound         = 3
+	ExitAlreadyInstalled = 4
+	ExitConstraint       = 5
+	ExitLocked           = 6
+	ExitConflict         = 7
+	ExitHookFailed       = 8
+	ExitDependents       = 9
+	ExitCancelled        = 130
+)
+
+// ErrorCode returns the stable code reported for err with --output json or
+// toml, and the status apkg exits with.
+func ErrorCode(err error) (string, int) {
+	var notFound *util.NotFoundError
+	var alreadyInstalled *util.AlreadyInstalledError
+	var constraint *util.ConstraintError
+	var cycle *util.CycleError
+	var locked *util.LockedError
+	var conflict *util.ConflictError
+	var hook *util.HookError
+	var dependents *util.DependentsError
+
+	switch {
+	case errors.As(err, &notFound):
+		return "not_found", ExitNotFound
+	case errors.As(err, &alreadyInstalled):
+		return "already_installed", ExitAlreadyInstalled
+	case errors.As(err, &constraint):
+		return "constraint", ExitConstraint
+	case errors.As(err, &cycle):
+		return "cycle", ExitConstraint
+	case errors.As(err, &locked):
+		return "locked", ExitLocked
+	case errors.As(err, &conflict):
+		return "conflict", ExitConflict
+	case errors.As(err, &hook):
+		return "hook_failed", ExitHookFailed
+	case errors.As(err, &dependents):
+		return "dependents", ExitDependents
+	case errors.Is(err, context.Canceled):
+		return "cancelled", ExitCancelled
+	default:
+		return "error", ExitError
+	}
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/innatical/apkg/v2/util"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode string
+		wantExit int
+	}{
+		{name: "not found", err: &util.NotFoundError{Kind: "Package", Name: "x"}, wantCode: "not_found", wantExit: ExitNotFound},
+		{name: "already installed", err: &util.AlreadyInstalledError{Name: "x"}, wantCode: "already_installed", wantExit: ExitAlreadyInstalled},
+		{name: "constraint", err: &util.ConstraintError{Package: "x", Constraint: "^1.0"}, wantCode: "constraint", wantExit: ExitConstraint},
+		{name: "cycle", err: &util.CycleError{Packages: []string{"a", "b", "a"}}, wantCode: "cycle", wantExit: ExitConstraint},
+		{name: "locked", err: &util.LockedError{PID: 1}, wantCode: "locked", wantExit: ExitLocked},
+		{name: "conflict", err: &util.ConflictError{}, wantCode: "conflict", wantExit: ExitConflict},
+		{name: "hook failed", err: &util.HookError{Package: "x", Hook: "postinstall", ExitStatus: 1}, wantCode: "hook_failed", wantExit: ExitHookFailed},
+		{name: "dependents", err: &util.DependentsError{Package: "x", Dependents: []string{"y"}}, wantCode: "dependents", wantExit: ExitDependents},
+		{name: "cancelled", err: context.Canceled, wantCode: "cancelled", wantExit: ExitCancelled},
+		{name: "other", err: &util.ErrorString{S: "Something"}, wantCode: "error", wantExit: ExitError},
+		{name: "wrapped", err: fmt.Errorf("installing: %w", &util.LockedError{}), wantCode: "locked", wantExit: ExitLocked},
+		{name: "failed rollback", err: &util.RollbackError{Err: &util.ConflictError{}, Rollback: errors.New("rollback")}, wantCode: "conflict", wantExit: ExitConflict},
+		{name: "already reported", err: &reportedError{err: &util.NotFoundError{Kind: "Package", Name: "x"}}, wantCode: "not_found", wantExit: ExitNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, exit := ErrorCode(test.err)
+
+			if code != test.wantCode || exit != test.wantExit {
+				t.Errorf("got %s, %d, want %s, %d", code, exit, test.wantCode, test.wantExit)
+			}
+		})
+	}
+}
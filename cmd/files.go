@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"github.com/innatical/apkg/v2/util"
+	"github.com/urfave/cli/v2"
+)
+
+type ownsOutput struct {
+	Path   string   `toml:"path" json:"path"`
+	Owners []string `toml:"owners" json:"owners"`
+}
+
+type filesOutput struct {
+	Package string        `toml:"package" json:"package"`
+	Files   []util.DBFile `toml:"files" json:"files"`
+}
+
+func Owns(c *cli.Context) error {
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	owners, err := manager.Owns(c.Context, c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, ownsOutput{Path: c.Args().First(), Owners: owners}, func() {
+		for _, owner := range owners {
+			printLine(owner)
+		}
+	})
+}
+
+func Files(c *cli.Context) error {
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	files, err := manager.Files(c.Context, c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, filesOutput{Package: c.Args().First(), Files: files}, func() {
+		for _, file := range files {
+			printLine(file.Path)
+		}
+	})
+}
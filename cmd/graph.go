@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/innatical/apkg/v2/util"
+	"github.com/urfave/cli/v2"
+)
+
+func Graph(c *cli.Context) error {
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	graph, err := manager.Graph(c.Context, c.Args().Slice())
+	if err != nil {
+		return err
+	}
+
+	if OutputFormat(c) == OutputDOT {
+		printDot(graph)
+		return nil
+	}
+
+	return writeOutput(c, graph, func() {
+		printTree(graph)
+	})
+}
+
+// printTree prints every package nothing else in the graph depends on with
+// its dependencies indented below it. Packages already expanded higher up
+// are marked with (*) instead of being expanded again.
+func printTree(graph *util.DependencyGraph) {
+	expanded := make(map[string]bool)
+
+	var walk func(node *util.GraphNode, prefix string)
+	walk = func(node *util.GraphNode, prefix string) {
+		expanded[node.Name] = true
+
+		for i, edge := range node.Dependencies {
+			branch, indent := "├── ", "│   "
+			if i == len(node.Dependencies)-1 {
+				branch, indent = "└── ", "    "
+			}
+
+			dependency := graph.Node(edge.Name)
+
+			line := prefix + branch + edgeLabel(edge)
+			if dependency != nil && expanded[dependency.Name] && len(dependency.Dependencies) != 0 {
+				line += " (*)"
+			}
+
+			printLine(line)
+
+			if dependency != nil && !expanded[dependency.Name] {
+				walk(dependency, prefix+indent)
+			}
+		}
+	}
+
+	for _, root := range graph.Roots() {
+		if expanded[root.Name] {
+			continue
+		}
+
+		printLine(root.Name + "@" + root.Version)
+		walk(root, "")
+	}
+}
+
+func edgeLabel(edge util.GraphEdge) string {
+	label := edge.Name
+
+	if edge.Version != "" {
+		label += "@" + edge.Version
+	}
+
+	if edge.Optional {
+		label += " (optional)"
+	}
+
+	if edge.Version == "" {
+		label += " [missing]"
+	} else if !edge.Satisfied {
+		label += " [unsatisfied: " + edge.Constraint + "]"
+	}
+
+	return label
+}
+
+// printDot prints the graph in Graphviz's DOT language. Optional
+// dependencies are dashed, unsatisfied ones red, and missing packages are
+// drawn as red dashed boxes.
+func printDot(graph *util.DependencyGraph) {
+	printLine("digraph apkg {")
+
+	var missing []string
+	seen := make(map[string]bool)
+
+	for _, node := range graph.Packages {
+		printLine(fmt.Sprintf("\t%s [label=%s];", strconv.Quote(node.Name), strconv.Quote(node.Name+"@"+node.Version)))
+	}
+
+	for _, node := range graph.Packages {
+		for _, edge := range node.Dependencies {
+			var attributes []string
+
+			if edge.Constraint != "" {
+				attributes = append(attributes, "label="+strconv.Quote(edge.Constraint))
+			}
+
+			if edge.Optional {
+				attributes = append(attributes, "style=dashed")
+			}
+
+			if !edge.Satisfied {
+				attributes = append(attributes, "color=red")
+			}
+
+			if edge.Version == "" && !seen[edge.Name] {
+				seen[edge.Name] = true
+				missing = append(missing, edge.Name)
+			}
+
+			printLine(fmt.Sprintf("\t%s -> %s%s;", strconv.Quote(node.Name), strconv.Quote(edge.Name), dotAttributes(attributes)))
+		}
+	}
+
+	for _, name := range missing {
+		printLine(fmt.Sprintf("\t%s [shape=box, style=dashed, color=red];", strconv.Quote(name)))
+	}
+
+	printLine("}")
+}
+
+func dotAttributes(attributes []string) string {
+	if len(attributes) == 0 {
+		return ""
+	}
+
+	return " [" + strings.Join(attributes, ", ") + "]"
+}
@@ -7,21 +7,27 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
+// infoOutput is a package's metadata together with whether its optional
+// dependencies are installed.
+type infoOutput struct {
+	util.PackageRoot
+	OptionalStatus []util.OptionalDependency `toml:"optional_status" json:"optional_status"`
+}
+
 func Info(c *cli.Context) error {
-	if err := util.LockDatabase(c.String("root")); err != nil {
+	var pkg *util.PackageRoot
+
+	manager, err := newManager(c)
+	if err != nil {
 		return err
 	}
 
-	defer util.UnlockDatabase(c.String("root"))
-
-	var pkg *util.PackageRoot
-
-	_, err := os.Stat(c.Args().First())
+	_, err = os.Stat(c.Args().First())
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return err
 		} else {
-			pkg, err = util.PackageInfo(c.String("root"), c.Args().First())
+			pkg, err = manager.Info(c.Context, c.Args().First())
 			if err != nil {
 				return err
 			}
@@ -33,36 +39,47 @@ func Info(c *cli.Context) error {
 		}
 	}
 
-	println(pkg.Package.Name + "@" + pkg.Package.Version)
-	println(pkg.Package.Description)
+	optional, err := manager.OptionalStatus(c.Context, pkg)
+	if err != nil {
+		return err
+	}
 
-	println()
+	return writeOutput(c, infoOutput{PackageRoot: *pkg, OptionalStatus: optional}, func() {
+		printLine(pkg.Package.Name + "@" + pkg.Package.Version)
+		printLine(pkg.Package.Description)
 
-	println("Authors:")
-	for i := range pkg.Package.Authors {
-		println(pkg.Package.Authors[i])
-	}
+		printLine("")
 
-	println()
+		printLine("Authors:")
+		for i := range pkg.Package.Authors {
+			printLine(pkg.Package.Authors[i])
+		}
 
-	println("Maintainers:")
-	for i := range pkg.Package.Maintainers {
-		println(pkg.Package.Maintainers[i])
-	}
+		printLine("")
 
-	println()
+		printLine("Maintainers:")
+		for i := range pkg.Package.Maintainers {
+			printLine(pkg.Package.Maintainers[i])
+		}
 
-	println("Dependencies:")
-	for i := range pkg.Dependencies.Required {
-		println(pkg.Dependencies.Required[i])
-	}
+		printLine("")
 
-	println()
+		printLine("Dependencies:")
+		for i := range pkg.Dependencies.Required {
+			printLine(pkg.Dependencies.Required[i])
+		}
 
-	println("Optional Dependencies:")
-	for i := range pkg.Dependencies.Optional {
-		println(pkg.Dependencies.Optional[i])
-	}
+		printLine("")
 
-	return nil
+		printLine("Optional Dependencies:")
+		for _, dependency := range optional {
+			if dependency.Version == "" {
+				printLine(dependency.String() + " (not installed)")
+			} else if !dependency.Satisfied {
+				printLine(dependency.String() + " (unsatisfied, " + dependency.Name + "@" + dependency.Version + " is installed)")
+			} else {
+				printLine(dependency.String() + " (installed " + dependency.Version + ")")
+			}
+		}
+	})
 }
@@ -1,21 +1,28 @@
 package cmd
 
 import (
-	"github.com/innatical/apkg/v2/util"
-
 	"github.com/urfave/cli/v2"
 )
 
 func Install(c *cli.Context) error {
-	if err := util.LockDatabase(c.String("root")); err != nil {
+	manager, err := newManager(c)
+	if err != nil {
 		return err
 	}
 
-	defer util.UnlockDatabase(c.String("root"))
+	if c.Bool("dry-run") {
+		plan, err := manager.PlanInstall(c.Context, c.Args().Slice())
+		if err != nil {
+			return err
+		}
+
+		return printPlan(c, plan)
+	}
 
-	if err := util.InstallMultiple(c.String("root"), c.Args().Slice()); err != nil {
+	changes, err := manager.Install(c.Context, c.Args().Slice())
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return writeChanges(c, changes)
 }
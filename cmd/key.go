@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"github.com/innatical/apkg/v2/util"
+	"github.com/urfave/cli/v2"
+)
+
+type keyOutput struct {
+	Name        string `toml:"name,omitempty" json:"name,omitempty"`
+	Fingerprint string `toml:"fingerprint" json:"fingerprint"`
+}
+
+type keyListOutput struct {
+	Keys []keyOutput `toml:"keys" json:"keys"`
+}
+
+type removedOutput struct {
+	Removed string `toml:"removed" json:"removed"`
+}
+
+func KeyGenerate(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return &util.ErrorString{S: "Usage: apkg key generate <private key path>"}
+	}
+
+	key, err := util.GenerateKey(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, keyOutput{Fingerprint: key.Fingerprint}, func() {
+		println("Generated key " + key.Fingerprint + ", public key written to " + c.Args().First() + ".pub")
+	})
+}
+
+func KeyAdd(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return &util.ErrorString{S: "Usage: apkg key add <name> <public key path>"}
+	}
+
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	key, err := manager.AddKey(c.Context, c.Args().Get(0), c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, keyOutput{Name: key.Name, Fingerprint: key.Fingerprint}, func() {
+		println("Trusted key " + key.Name + " (" + key.Fingerprint + ")")
+	})
+}
+
+func KeyRemove(c *cli.Context) error {
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	if err := manager.RemoveKey(c.Context, c.Args().First()); err != nil {
+		return err
+	}
+
+	return writeOutput(c, removedOutput{Removed: c.Args().First()}, nil)
+}
+
+func KeyList(c *cli.Context) error {
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	keys, err := manager.Keys(c.Context)
+	if err != nil {
+		return err
+	}
+
+	output := keyListOutput{Keys: []keyOutput{}}
+	table := make(map[string]string)
+	maxWidth := 0
+
+	for _, key := range keys {
+		output.Keys = append(output.Keys, keyOutput{Name: key.Name, Fingerprint: key.Fingerprint})
+		table[key.Name] = key.Fingerprint
+
+		lineWidth := len(key.Name) + 5 + len(key.Fingerprint)
+		if lineWidth > maxWidth {
+			maxWidth = lineWidth
+		}
+	}
+
+	return writeOutput(c, output, func() {
+		printLine(util.RenderTable(table, maxWidth))
+	})
+}
@@ -5,31 +5,41 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
+type listOutput struct {
+	Packages []util.DBPackage `toml:"packages" json:"packages"`
+}
+
 func List(c *cli.Context) error {
-	if err := util.LockDatabase(c.String("root")); err != nil {
+	manager, err := newManager(c)
+	if err != nil {
 		return err
 	}
 
-	defer util.UnlockDatabase(c.String("root"))
-
-	installed, err := util.ListInstalled(c.String("root"))
+	installed, err := manager.List(c.Context)
 	if err != nil {
 		return err
 	}
 
-	table := make(map[string]string)
-	maxWidth := 0
+	output := listOutput{Packages: installed}
 
-	for _, dbPackage := range installed {
-		table[dbPackage.Package.Name+"@"+dbPackage.Package.Version] = dbPackage.Hash
+	return writeOutput(c, output, func() {
+		table := make(map[string]string)
+		maxWidth := 0
 
-		lineWidth := len(dbPackage.Package.Name) + 1 + len(dbPackage.Package.Version) + 5 + len(dbPackage.Hash)
-		if lineWidth > maxWidth {
-			maxWidth = lineWidth
-		}
-	}
+		for _, dbPackage := range installed {
+			label := dbPackage.Package.Name + "@" + dbPackage.Package.Version
+			if dbPackage.Reason == util.ReasonDependency {
+				label += " (dependency)"
+			}
 
-	println(util.RenderTable(table, maxWidth))
+			table[label] = dbPackage.Hash
+
+			lineWidth := len(label) + 5 + len(dbPackage.Hash)
+			if lineWidth > maxWidth {
+				maxWidth = lineWidth
+			}
+		}
 
-	return nil
+		printLine(util.RenderTable(table, maxWidth))
+	})
 }
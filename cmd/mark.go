@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"github.com/innatical/apkg/v2/util"
+	"github.com/urfave/cli/v2"
+)
+
+type markOutput struct {
+	Packages []string `toml:"packages" json:"packages"`
+	Reason   string   `toml:"reason" json:"reason"`
+}
+
+func Mark(c *cli.Context) error {
+	if c.NArg() < 2 {
+		return &util.ErrorString{S: "Usage: apkg mark <explicit|dependency> <package names...>"}
+	}
+
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	reason := c.Args().First()
+	names := c.Args().Tail()
+
+	if err := manager.Mark(c.Context, names, reason); err != nil {
+		return err
+	}
+
+	return writeOutput(c, markOutput{Packages: names, Reason: reason}, func() {
+		for _, name := range names {
+			println("Marked " + name + " as " + reason)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/innatical/apkg/v2/apkg"
+	"github.com/innatical/apkg/v2/util"
+	"github.com/urfave/cli/v2"
+)
+
+// newManager creates a Manager for the root given on the command line, from
+// the global flags. With --wait it waits for other apkg processes to finish,
+// up to --wait-timeout if one is set. Hooks write to stderr instead of
+// stdout when results are printed as json or toml.
+func newManager(c *cli.Context) (*apkg.Manager, error) {
+	policy, err := util.ParseSignaturePolicy(c.String("signatures"))
+	if err != nil {
+		return nil, err
+	}
+
+	maxSize, err := parseSize(c.String("max-size"))
+	if err != nil {
+		return nil, err
+	}
+
+	maxFileSize, err := parseSize(c.String("max-file-size"))
+	if err != nil {
+		return nil, err
+	}
+
+	wait := c.Duration("wait-timeout")
+	if !c.Bool("wait") {
+		wait = 0
+	} else if wait <= 0 {
+		wait = -1
+	}
+
+	hooks := util.HooksRun
+	if c.Bool("skip-hooks") {
+		hooks = util.HooksSkip
+	}
+
+	var stdout io.Writer = os.Stdout
+	if OutputFormat(c) != OutputText {
+		stdout = os.Stderr
+	}
+
+	return apkg.New(apkg.Options{
+		Root:       c.String("root"),
+		Stdout:     stdout,
+		Stderr:     os.Stderr,
+		Hooks:      hooks,
+		Signatures: policy,
+		Extract: util.ExtractOptions{
+			AllowDevices: c.Bool("allow-devices"),
+			AllowSetuid:  c.Bool("allow-setuid"),
+			MaxTotalSize: maxSize,
+			MaxFileSize:  maxFileSize,
+			MaxEntries:   c.Int("max-entries"),
+			MaxDepth:     c.Int("max-depth"),
+		},
+		Wait: wait,
+	})
+}
+
+// parseSize parses a byte count with an optional K, M, G or T suffix.
+func parseSize(size string) (int64, error) {
+	multiplier := int64(1)
+
+	trimmed := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(trimmed, suffix) {
+			trimmed = strings.TrimSuffix(trimmed, suffix)
+			multiplier = int64(1) << (10 * (i + 1))
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(trimmed, 10, 64)
+	if err != nil || value < 0 {
+		return 0, &util.ErrorString{S: "Invalid size " + size}
+	}
+
+	return value * multiplier, nil
+}
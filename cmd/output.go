@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/BurntSushi/toml"
+	"github.com/innatical/apkg/v2/apkg"
+	"github.com/innatical/apkg/v2/util"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+	OutputTOML = "toml"
+
+	// OutputDOT renders a dependency graph in Graphviz's DOT language. Only
+	// graph supports it.
+	OutputDOT = "dot"
+)
+
+// OutputFormat returns the format given with the global --output flag. It is
+// read from the root context since build has an --output flag of its own.
+func OutputFormat(c *cli.Context) string {
+	lineage := c.Lineage()
+
+	for i := len(lineage) - 1; i >= 0; i-- {
+		if lineage[i].App != nil {
+			return lineage[i].String("output")
+		}
+	}
+
+	return OutputText
+}
+
+// CheckOutputFormat validates --output before any command runs, so that a
+// command never changes the root only to fail on the format afterwards.
+func CheckOutputFormat(c *cli.Context) error {
+	switch OutputFormat(c) {
+	case OutputText, OutputJSON, OutputTOML:
+		return nil
+	case OutputDOT:
+		if command := c.App.Command(c.Args().First()); command != nil && command.Name == "graph" {
+			return nil
+		}
+
+		return &util.ErrorString{S: "Output format dot is only supported by graph"}
+	}
+
+	return &util.ErrorString{S: "Unknown output format " + OutputFormat(c) + ", expected text, json, toml or dot"}
+}
+
+// writeOutput prints the result of a command on stdout in the format given
+// with --output. For text, the command's own renderer is called instead,
+// which prints its lines with printLine.
+func writeOutput(c *cli.Context, value interface{}, text func()) error {
+	if OutputFormat(c) == OutputText {
+		if text != nil {
+			text()
+		}
+
+		return nil
+	}
+
+	return encodeOutput(OutputFormat(c), value)
+}
+
+// printLine prints a line of a command's text output on stdout, where the
+// json and toml documents go. Progress messages and errors go to stderr.
+func printLine(line string) {
+	fmt.Fprintln(os.Stdout, line)
+}
+
+func encodeOutput(format string, value interface{}) error {
+	value = withEmptySlices(value)
+
+	if format == OutputTOML {
+		return toml.NewEncoder(os.Stdout).Encode(value)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(value)
+}
+
+// withEmptySlices returns a copy of value in which every nil slice or map is
+// replaced by an empty one, so that lists are always written as [] and
+// tables as {}, never as null or left out.
+func withEmptySlices(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	copied := reflect.New(reflect.TypeOf(value)).Elem()
+	copied.Set(reflect.ValueOf(value))
+	fillSlices(copied)
+
+	return copied.Interface()
+}
+
+func fillSlices(value reflect.Value) {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return
+		}
+
+		// Pointed-to values are copied rather than changed in place, as
+		// they may belong to the caller.
+		elem := reflect.New(value.Elem().Type()).Elem()
+		elem.Set(value.Elem())
+		fillSlices(elem)
+
+		if value.Kind() == reflect.Ptr {
+			pointer := reflect.New(elem.Type())
+			pointer.Elem().Set(elem)
+			value.Set(pointer)
+		} else {
+			value.Set(elem)
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if field := value.Field(i); field.CanSet() {
+				fillSlices(field)
+			}
+		}
+	case reflect.Slice:
+		if value.IsNil() {
+			value.Set(reflect.MakeSlice(value.Type(), 0, 0))
+			return
+		}
+
+		copied := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		reflect.Copy(copied, value)
+
+		for i := 0; i < copied.Len(); i++ {
+			fillSlices(copied.Index(i))
+		}
+
+		value.Set(copied)
+	case reflect.Map:
+		copied := reflect.MakeMapWithSize(value.Type(), value.Len())
+
+		for _, key := range value.MapKeys() {
+			elem := reflect.New(value.Type().Elem()).Elem()
+			elem.Set(value.MapIndex(key))
+			fillSlices(elem)
+			copied.SetMapIndex(key, elem)
+		}
+
+		value.Set(copied)
+	}
+}
+
+// errorOutput is how a failed command reports its error with --output json
+// or toml.
+type errorOutput struct {
+	Error errorDetail `toml:"error" json:"error"`
+}
+
+type errorDetail struct {
+	Code    string `toml:"code" json:"code"`
+	Message string `toml:"message" json:"message"`
+}
+
+// reportedError is an error a command already reported inside the document
+// it wrote with --output json or toml, so that every run writes exactly one
+// document.
+type reportedError struct {
+	err error
+}
+
+func (e *reportedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *reportedError) Unwrap() error {
+	return e.err
+}
+
+// reportError returns the detail of err for a command to put in its output
+// document, and err marked as reported.
+func reportError(err error) (*errorDetail, error) {
+	code, _ := ErrorCode(err)
+
+	return &errorDetail{Code: code, Message: err.Error()}, &reportedError{err: err}
+}
+
+// WriteError reports the error a command failed with on stdout, in the
+// machine-readable format given with --output, unless the command already
+// reported it in its own output.
+func WriteError(format string, err error) error {
+	var reported *reportedError
+	if errors.As(err, &reported) {
+		return nil
+	}
+
+	code, _ := ErrorCode(err)
+
+	return encodeOutput(format, errorOutput{Error: errorDetail{Code: code, Message: err.Error()}})
+}
+
+// writeChanges prints the packages a mutating command changed. In text mode
+// nothing is printed; hooks already report what they do.
+func writeChanges(c *cli.Context, changes *apkg.Changes) error {
+	return writeOutput(c, changes, nil)
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/innatical/apkg/v2/apkg"
+	"github.com/innatical/apkg/v2/util"
+)
+
+func TestWithEmptySlices(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []string
+	}{
+		{
+			name:  "info",
+			value: infoOutput{PackageRoot: util.PackageRoot{Package: util.Package{Name: "x"}}},
+			want:  []string{`"authors":[]`, `"maintainers":[]`, `"required":[]`, `"optional":[]`, `"optional_status":[]`},
+		},
+		{
+			name:  "list",
+			value: listOutput{Packages: []util.DBPackage{{Package: util.Package{Name: "x"}}}},
+			want:  []string{`"authors":[]`, `"required":[]`},
+		},
+		{
+			name:  "changes",
+			value: &apkg.Changes{},
+			want:  []string{`"installed":[]`, `"removed":[]`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := json.Marshal(withEmptySlices(test.value))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Contains(string(encoded), "null") {
+				t.Errorf("got %s, want no nulls", encoded)
+			}
+
+			for _, want := range test.want {
+				if !strings.Contains(string(encoded), want) {
+					t.Errorf("got %s, want it to contain %s", encoded, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWithEmptySlicesCopies(t *testing.T) {
+	pkg := &util.DBPackage{}
+	packages := []util.DBPackage{{}}
+
+	withEmptySlices(pkg)
+	withEmptySlices(listOutput{Packages: packages})
+
+	if pkg.Package.Authors != nil || packages[0].Package.Authors != nil {
+		t.Error("withEmptySlices changed the value it was given")
+	}
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/innatical/apkg/v2/util"
+	"github.com/urfave/cli/v2"
+)
+
+type planOutput struct {
+	util.Plan
+	Error *errorDetail `toml:"error,omitempty" json:"error,omitempty"`
+}
+
+// printPlan prints the plan of a --dry-run and fails when the plan has
+// blocked packages.
+func printPlan(c *cli.Context, plan *util.Plan) error {
+	output := planOutput{Plan: *plan}
+
+	var failed error
+	if len(plan.Blocked) != 0 {
+		output.Error, failed = reportError(&util.ErrorString{S: strconv.Itoa(len(plan.Blocked)) + " packages are blocked"})
+	}
+
+	if err := writeOutput(c, output, func() {
+		printPlannedPackages("install", "link", plan.Install)
+		printPlannedPackages("remove", "unlink", plan.Remove)
+
+		for _, blocked := range plan.Blocked {
+			printLine("blocked " + blocked.Name + ": " + blocked.Reason)
+		}
+	}); err != nil {
+		return err
+	}
+
+	return failed
+}
+
+func printPlannedPackages(action string, fileAction string, packages []util.PlannedPackage) {
+	for _, pkg := range packages {
+		if pkg.File != "" {
+			printLine(fmt.Sprintf("%s %s@%s (%s)", action, pkg.Name, pkg.Version, pkg.File))
+		} else if pkg.Repository != "" {
+			printLine(fmt.Sprintf("%s %s@%s (from %s)", action, pkg.Name, pkg.Version, pkg.Repository))
+		} else {
+			printLine(fmt.Sprintf("%s %s@%s", action, pkg.Name, pkg.Version))
+		}
+
+		for _, hook := range pkg.Hooks {
+			if strings.HasPrefix(hook.Name, "pre") {
+				printLine(fmt.Sprintf("  hook   %s %s", hook.Name, hook.Path))
+			}
+		}
+
+		for _, file := range pkg.Files {
+			printLine(fmt.Sprintf("  %-6s %s", fileAction, file.Path))
+		}
+
+		for _, hook := range pkg.Hooks {
+			if strings.HasPrefix(hook.Name, "post") {
+				printLine(fmt.Sprintf("  hook   %s %s", hook.Name, hook.Path))
+			}
+		}
+	}
+}
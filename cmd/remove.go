@@ -1,20 +1,106 @@
 package cmd
 
 import (
+	"strconv"
+	"strings"
+
+	"github.com/innatical/apkg/v2/apkg"
 	"github.com/innatical/apkg/v2/util"
 	"github.com/urfave/cli/v2"
 )
 
+// removeOutput is the changes remove made. Dependents are the packages
+// --recursive removed because they depend on the named packages, in the
+// order they were removed in.
+type removeOutput struct {
+	apkg.Changes
+	Dependents []string `toml:"dependents" json:"dependents"`
+}
+
 func Remove(c *cli.Context) error {
-	if err := util.LockDatabase(c.String("root")); err != nil {
+	if c.NArg() == 0 {
+		return &util.ErrorString{S: "Usage: apkg remove [command options] <package names...>"}
+	}
+
+	manager, err := newManager(c)
+	if err != nil {
 		return err
 	}
 
-	defer util.UnlockDatabase(c.String("root"))
+	options := apkg.RemoveOptions{Recursive: c.Bool("recursive")}
+
+	if c.Bool("dry-run") {
+		plan, err := manager.PlanRemove(c.Context, c.Args().Slice(), options)
+		if err != nil {
+			return err
+		}
+
+		return printPlan(c, plan)
+	}
+
+	output := removeOutput{Dependents: []string{}}
+
+	// Removing dependents as well can take out much more than was named, so
+	// the full list is shown before anything is removed, and the dependents
+	// are listed in the json and toml output.
+	if options.Recursive {
+		named := make(map[string]bool)
+		for _, name := range c.Args().Slice() {
+			named[name] = true
+		}
+
+		options.Confirm = func(names []string) error {
+			for _, name := range names {
+				if !named[name] {
+					output.Dependents = append(output.Dependents, name)
+				}
+			}
+
+			if OutputFormat(c) == OutputText {
+				println("Removing " + strconv.Itoa(len(names)) + " packages: " + strings.Join(names, ", "))
+			}
+
+			return nil
+		}
+	}
 
-	if err := util.Remove(c.String("root"), c.Args().First()); err != nil {
+	changes, err := manager.Remove(c.Context, c.Args().Slice(), options)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	output.Changes = *changes
+
+	return writeOutput(c, output, nil)
+}
+
+func Autoremove(c *cli.Context) error {
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("dry-run") {
+		plan, err := manager.PlanAutoremove(c.Context)
+		if err != nil {
+			return err
+		}
+
+		return printPlan(c, plan)
+	}
+
+	changes, err := manager.Autoremove(c.Context)
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, changes, func() {
+		if len(changes.Removed) == 0 {
+			println("No orphaned packages to remove")
+		}
+
+		for _, pkg := range changes.Removed {
+			println("Removed " + pkg.Package.Name + "@" + pkg.Package.Version)
+		}
+	})
 }
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/innatical/apkg/v2/util"
+	"github.com/urfave/cli/v2"
+)
+
+type repairOutput struct {
+	Repaired []util.VerifyResult `toml:"repaired" json:"repaired"`
+}
+
+func Repair(c *cli.Context) error {
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	repaired, err := manager.Repair(c.Context, c.Args().Slice(), c.Bool("hooks"))
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, repairOutput{Repaired: repaired}, func() {
+		for _, result := range repaired {
+			printLine(fmt.Sprintf("repaired  %s (%s): was %s", result.Path, result.Package, result.Status))
+		}
+	})
+}
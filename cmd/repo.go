@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"strconv"
+
+	"github.com/innatical/apkg/v2/util"
+	"github.com/urfave/cli/v2"
+)
+
+type repositoryOutput struct {
+	Name string `toml:"name" json:"name"`
+	URL  string `toml:"url" json:"url"`
+}
+
+type repositoryListOutput struct {
+	Repositories []repositoryOutput `toml:"repositories" json:"repositories"`
+}
+
+type indexOutput struct {
+	Directory string `toml:"directory" json:"directory"`
+	Packages  int    `toml:"packages" json:"packages"`
+}
+
+func RepoAdd(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return &util.ErrorString{S: "Usage: apkg repo add <name> <url>"}
+	}
+
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	if err := manager.AddRepository(c.Context, c.Args().Get(0), c.Args().Get(1)); err != nil {
+		return err
+	}
+
+	return writeOutput(c, repositoryOutput{Name: c.Args().Get(0), URL: c.Args().Get(1)}, nil)
+}
+
+func RepoRemove(c *cli.Context) error {
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	if err := manager.RemoveRepository(c.Context, c.Args().First()); err != nil {
+		return err
+	}
+
+	return writeOutput(c, removedOutput{Removed: c.Args().First()}, nil)
+}
+
+func RepoList(c *cli.Context) error {
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	repositories, err := manager.Repositories(c.Context)
+	if err != nil {
+		return err
+	}
+
+	output := repositoryListOutput{Repositories: []repositoryOutput{}}
+	table := make(map[string]string)
+	maxWidth := 0
+
+	for _, repository := range repositories {
+		output.Repositories = append(output.Repositories, repositoryOutput{Name: repository.Name, URL: repository.URL})
+		table[repository.Name] = repository.URL
+
+		lineWidth := len(repository.Name) + 5 + len(repository.URL)
+		if lineWidth > maxWidth {
+			maxWidth = lineWidth
+		}
+	}
+
+	return writeOutput(c, output, func() {
+		printLine(util.RenderTable(table, maxWidth))
+	})
+}
+
+func RepoIndex(c *cli.Context) error {
+	directory := c.Args().First()
+	if directory == "" {
+		directory = "."
+	}
+
+	index, err := util.GenerateIndex(directory)
+	if err != nil {
+		return err
+	}
+
+	if err := util.WriteIndex(directory, index); err != nil {
+		return err
+	}
+
+	return writeOutput(c, indexOutput{Directory: directory, Packages: len(index.Packages)}, func() {
+		println("Indexed " + strconv.Itoa(len(index.Packages)) + " packages in " + directory)
+	})
+}
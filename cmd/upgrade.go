@@ -0,0 +1,19 @@
+package cmd
+
+import (
+	"github.com/urfave/cli/v2"
+)
+
+func Upgrade(c *cli.Context) error {
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	changes, err := manager.Upgrade(c.Context, c.Args().Slice())
+	if err != nil {
+		return err
+	}
+
+	return writeChanges(c, changes)
+}
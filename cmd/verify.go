@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/innatical/apkg/v2/util"
+	"github.com/urfave/cli/v2"
+)
+
+type verifyOutput struct {
+	Results []util.VerifyResult `toml:"results" json:"results"`
+	Error   *errorDetail        `toml:"error,omitempty" json:"error,omitempty"`
+}
+
+func Verify(c *cli.Context) error {
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	results, err := manager.Verify(c.Context, c.Args().Slice())
+	if err != nil {
+		return err
+	}
+
+	output := verifyOutput{Results: results}
+
+	var failed error
+	if len(results) != 0 {
+		output.Error, failed = reportError(&util.ErrorString{S: strconv.Itoa(len(results)) + " files failed verification"})
+	}
+
+	// Failed files are listed on stdout, the summary main prints on stderr.
+	if err := writeOutput(c, output, func() {
+		for _, result := range results {
+			printLine(fmt.Sprintf("%-9s %s (%s): %s", result.Status, result.Path, result.Package, result.Detail))
+		}
+	}); err != nil {
+		return err
+	}
+
+	return failed
+}
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/innatical/apkg/v2/util"
+	"github.com/urfave/cli/v2"
+)
+
+func Why(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return &util.ErrorString{S: "Usage: apkg why <package name>"}
+	}
+
+	manager, err := newManager(c)
+	if err != nil {
+		return err
+	}
+
+	result, err := manager.Why(c.Context, c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	return writeOutput(c, result, func() {
+		if result.Reason == util.ReasonDependency {
+			printLine(result.Package + " is installed as a dependency")
+		} else {
+			printLine(result.Package + " is installed explicitly")
+		}
+
+		if result.Reason == util.ReasonDependency && len(result.Chains) == 0 {
+			printLine("No explicitly installed package depends on it")
+		}
+
+		for _, chain := range result.Chains {
+			if len(chain.Links) == 1 {
+				continue
+			}
+
+			var line strings.Builder
+
+			for i, link := range chain.Links {
+				if i != 0 {
+					line.WriteString(" -> ")
+				}
+
+				line.WriteString(link.Name)
+
+				if link.Optional {
+					line.WriteString(" (optional)")
+				}
+			}
+
+			printLine(line.String())
+		}
+
+		if len(result.Breaks) != 0 {
+			printLine("Removing it would also remove: " + strings.Join(result.Breaks, ", "))
+		}
+	})
+}
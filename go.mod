@@ -6,13 +6,14 @@ require (
 	github.com/BurntSushi/toml v0.4.1
 	github.com/Masterminds/semver v1.5.0
 	github.com/charmbracelet/lipgloss v0.4.0
+	github.com/goombaio/dag v0.0.0-20181006234417-a8874b1f72ff
 	github.com/klauspost/compress v1.13.6
 	github.com/urfave/cli/v2 v2.3.0
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 )
 
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.1 // indirect
-	github.com/goombaio/dag v0.0.0-20181006234417-a8874b1f72ff // indirect
 	github.com/goombaio/orderedmap v0.0.0-20180924084748-ba921b7e2419 // indirect
 	github.com/goombaio/orderedset v0.0.0-20180924084730-d1b9fdd81eca // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
@@ -22,6 +23,5 @@ require (
 	github.com/muesli/termenv v0.9.0 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.org/x/sys v0.0.0-20211030160813-b3129d9d1021 // indirect
 )
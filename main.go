@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"syscall"
 
 	"github.com/innatical/apkg/v2/cmd"
+	"github.com/innatical/apkg/v2/util"
 
 	"github.com/charmbracelet/lipgloss"
 	"github.com/urfave/cli/v2"
@@ -13,6 +17,8 @@ import (
 
 var errorStyle = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("#FF0000"))
 
+var outputFormat = cmd.OutputText
+
 func main() {
 	usr, err := user.Current()
 	if err != nil {
@@ -30,21 +36,117 @@ func main() {
 				Value: filepath.Join(usr.HomeDir, "/.apkg"),
 				Usage: "The root directory for the apkg package manager",
 			},
+			&cli.BoolFlag{
+				Name:  "wait",
+				Usage: "Wait for other apkg processes to release the database instead of failing",
+			},
+			&cli.DurationFlag{
+				Name:  "wait-timeout",
+				Usage: "Give up waiting for the database after this long (0 waits forever)",
+			},
+			&cli.StringFlag{
+				Name:        "output",
+				Value:       cmd.OutputText,
+				Usage:       "The format to print results and errors in: text, json, toml, or dot for graph",
+				Destination: &outputFormat,
+			},
+			&cli.BoolFlag{
+				Name:  "skip-hooks",
+				Usage: "Don't run package hooks",
+			},
+			&cli.StringFlag{
+				Name:  "signatures",
+				Value: string(util.SignatureWarn),
+				Usage: "Signature policy for installed packages: require, warn or off",
+			},
+			&cli.BoolFlag{
+				Name:  "allow-devices",
+				Usage: "Allow packages to contain device nodes",
+			},
+			&cli.BoolFlag{
+				Name:  "allow-setuid",
+				Usage: "Allow packages to contain setuid and setgid files",
+			},
+			&cli.StringFlag{
+				Name:  "max-size",
+				Value: "4G",
+				Usage: "The most data a package may extract to (0 for no limit)",
+			},
+			&cli.StringFlag{
+				Name:  "max-file-size",
+				Value: "2G",
+				Usage: "The largest file a package may contain (0 for no limit)",
+			},
+			&cli.IntFlag{
+				Name:  "max-entries",
+				Value: 100000,
+				Usage: "The most files and directories a package may contain (0 for no limit)",
+			},
+			&cli.IntFlag{
+				Name:  "max-depth",
+				Value: 64,
+				Usage: "The deepest path a package may contain (0 for no limit)",
+			},
 		},
+		Before: cmd.CheckOutputFormat,
+		// Errors are reported below, in the format chosen with --output.
+		ExitErrHandler: func(c *cli.Context, err error) {},
 		Commands: []*cli.Command{
 			{
 				Name:      "install",
 				Usage:     "Install a package",
-				UsageText: "apkg install <package files...>",
+				UsageText: "apkg install [command options] <package files|package names...>",
 				Aliases:   []string{"i"},
-				Action:    cmd.Install,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Print what would be done without changing anything",
+					},
+				},
+				Action: cmd.Install,
+			},
+			{
+				Name:      "upgrade",
+				Usage:     "Upgrade installed packages",
+				UsageText: "apkg upgrade [package files|package names...]",
+				Aliases:   []string{"u"},
+				Action:    cmd.Upgrade,
 			},
 			{
 				Name:      "remove",
-				Usage:     "Remove a package",
-				UsageText: "apkg remove <package name>",
+				Usage:     "Remove packages",
+				UsageText: "apkg remove [command options] <package names...>",
 				Aliases:   []string{"r"},
-				Action:    cmd.Remove,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Print what would be done without changing anything",
+					},
+					&cli.BoolFlag{
+						Name:    "recursive",
+						Aliases: []string{"R"},
+						Usage:   "Also remove every package that depends on the named packages",
+					},
+				},
+				Action: cmd.Remove,
+			},
+			{
+				Name:      "autoremove",
+				Usage:     "Remove packages that were only installed as dependencies and are no longer required",
+				UsageText: "apkg autoremove [command options]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Print what would be done without changing anything",
+					},
+				},
+				Action: cmd.Autoremove,
+			},
+			{
+				Name:      "mark",
+				Usage:     "Record whether packages were installed explicitly or as dependencies",
+				UsageText: "apkg mark <explicit|dependency> <package names...>",
+				Action:    cmd.Mark,
 			},
 			{
 				Name:      "list",
@@ -60,11 +162,147 @@ func main() {
 				Aliases:   []string{"in"},
 				Action:    cmd.Info,
 			},
+			{
+				Name:      "why",
+				Usage:     "Show why a package is installed and what depends on it",
+				UsageText: "apkg why <package name>",
+				Aliases:   []string{"w"},
+				Action:    cmd.Why,
+			},
+			{
+				Name:      "graph",
+				Usage:     "Show the dependency graph of the installed packages or of package files",
+				UsageText: "apkg graph [command options] [package files...]",
+				Aliases:   []string{"g"},
+				Action:    cmd.Graph,
+			},
+			{
+				Name:      "owns",
+				Usage:     "Find the package that installed a path",
+				UsageText: "apkg owns <path>",
+				Aliases:   []string{"o"},
+				Action:    cmd.Owns,
+			},
+			{
+				Name:      "files",
+				Usage:     "List the files installed by a package",
+				UsageText: "apkg files <package name>",
+				Aliases:   []string{"f"},
+				Action:    cmd.Files,
+			},
+			{
+				Name:      "verify",
+				Usage:     "Check installed files against the package store",
+				UsageText: "apkg verify [package names...]",
+				Aliases:   []string{"v"},
+				Action:    cmd.Verify,
+			},
+			{
+				Name:      "repair",
+				Usage:     "Relink missing or modified files from the package store",
+				UsageText: "apkg repair [command options] [package names...]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "hooks",
+						Usage: "Run the postinstall hook of every repaired package",
+					},
+				},
+				Action: cmd.Repair,
+			},
+			{
+				Name:      "build",
+				Usage:     "Build a package archive from a directory",
+				UsageText: "apkg build [command options] [source directory]",
+				Aliases:   []string{"b"},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "The path to write the package archive to",
+					},
+					&cli.StringFlag{
+						Name:  "sign",
+						Usage: "Sign the archive with the private key at this path",
+					},
+				},
+				Action: cmd.Build,
+			},
+			{
+				Name:  "key",
+				Usage: "Manage the keys trusted to sign packages",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "add",
+						Usage:     "Trust a public key",
+						UsageText: "apkg key add <name> <public key path>",
+						Action:    cmd.KeyAdd,
+					},
+					{
+						Name:      "remove",
+						Usage:     "Stop trusting a key",
+						UsageText: "apkg key remove <name>",
+						Action:    cmd.KeyRemove,
+					},
+					{
+						Name:      "list",
+						Usage:     "List all trusted keys",
+						UsageText: "apkg key list",
+						Action:    cmd.KeyList,
+					},
+					{
+						Name:      "generate",
+						Usage:     "Generate a key pair for signing packages",
+						UsageText: "apkg key generate <private key path>",
+						Action:    cmd.KeyGenerate,
+					},
+				},
+			},
+			{
+				Name:  "repo",
+				Usage: "Manage package repositories",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "add",
+						Usage:     "Add a package repository",
+						UsageText: "apkg repo add <name> <url>",
+						Action:    cmd.RepoAdd,
+					},
+					{
+						Name:      "remove",
+						Usage:     "Remove a package repository",
+						UsageText: "apkg repo remove <name>",
+						Action:    cmd.RepoRemove,
+					},
+					{
+						Name:      "list",
+						Usage:     "List all configured repositories",
+						UsageText: "apkg repo list",
+						Action:    cmd.RepoList,
+					},
+					{
+						Name:      "index",
+						Usage:     "Generate the index for a directory of packages",
+						UsageText: "apkg repo index [directory]",
+						Action:    cmd.RepoIndex,
+					},
+				},
+			},
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		println(errorStyle.Render("Error: ") + err.Error())
-		os.Exit(1)
+	// Interrupting apkg cancels the running operation, which rolls back
+	// whatever it already changed.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		if outputFormat == cmd.OutputJSON || outputFormat == cmd.OutputTOML {
+			cmd.WriteError(outputFormat, err)
+		} else {
+			println(errorStyle.Render("Error: ") + err.Error())
+		}
+
+		_, status := cmd.ErrorCode(err)
+		os.Exit(status)
 	}
 }
@@ -0,0 +1,237 @@
+package util
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Archive is what a single read of a package archive yields: the sha256
+// hash of the file, its package.toml and the headers of its entries. An
+// Archive from ExtractArchive has also been extracted into a temporary
+// store, which Install moves into place.
+type Archive struct {
+	Path    string
+	Hash    string
+	Package *PackageRoot
+
+	headers map[string]*tar.Header
+	store   string
+}
+
+// ReadArchive reads a package archive in one pass without extracting it,
+// hashing the compressed bytes while walking the tar stream.
+func ReadArchive(tarball string) (*Archive, error) {
+	reader, err := os.Open(tarball)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	tee := io.TeeReader(reader, hasher)
+
+	zstdReader, err := zstd.NewReader(tee)
+	if err != nil {
+		return nil, err
+	}
+	defer zstdReader.Close()
+	tarReader := tar.NewReader(zstdReader)
+
+	archive := &Archive{Path: tarball, headers: make(map[string]*tar.Header)}
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(header.Name)
+		archive.headers[name] = header
+
+		if name == "package.toml" && archive.Package == nil {
+			var pkg PackageRoot
+
+			if _, err := toml.DecodeReader(tarReader, &pkg); err != nil {
+				return nil, err
+			}
+
+			archive.Package = &pkg
+		}
+	}
+
+	if archive.Package == nil {
+		return nil, &ErrorString{S: "package.toml not found"}
+	}
+
+	if err := drainArchive(zstdReader, tee); err != nil {
+		return nil, err
+	}
+
+	archive.Hash = hex.EncodeToString(hasher.Sum(nil))
+
+	return archive, nil
+}
+
+// ReadArchives reads every one of the given package archives.
+func ReadArchives(packageFiles []string) ([]*Archive, error) {
+	archives := make([]*Archive, 0, len(packageFiles))
+
+	for _, file := range packageFiles {
+		archive, err := ReadArchive(file)
+		if err != nil {
+			return nil, err
+		}
+
+		archives = append(archives, archive)
+	}
+
+	return archives, nil
+}
+
+// ExtractArchive extracts a package archive into a temporary store under
+// packages in a single read: the compressed bytes are hashed and the entry
+// headers recorded while the archive is extracted, and package.toml is read
+// from the extracted tree. The hash that signatures are checked against is
+// therefore always the hash of the files that get installed. The store is
+// removed again on rollback.
+func ExtractArchive(tx *Transaction, tarball string, options ExtractOptions) (*Archive, error) {
+	store, err := tx.CreateTempStore(filepath.Join(tx.Root, "packages"))
+	if err != nil {
+		return nil, err
+	}
+
+	archive := &Archive{Path: tarball, headers: make(map[string]*tar.Header), store: store}
+
+	hash, err := extractArchive(tarball, store, options, archive.headers)
+	if err != nil {
+		os.RemoveAll(store)
+		return nil, err
+	}
+
+	archive.Hash = hash
+
+	if _, ok := archive.headers["package.toml"]; !ok {
+		return nil, &ErrorString{S: "package.toml not found"}
+	}
+
+	archive.Package, err = ParsePackageFile(filepath.Join(store, "package.toml"))
+	if err != nil {
+		return nil, err
+	}
+
+	return archive, nil
+}
+
+// ExtractArchives extracts every one of the given package archives.
+func ExtractArchives(tx *Transaction, packageFiles []string, options ExtractOptions) ([]*Archive, error) {
+	archives := make([]*Archive, 0, len(packageFiles))
+
+	for _, file := range packageFiles {
+		if err := tx.env.cancelled(); err != nil {
+			return nil, err
+		}
+
+		archive, err := ExtractArchive(tx, file, options)
+		if err != nil {
+			return nil, err
+		}
+
+		archives = append(archives, archive)
+	}
+
+	return archives, nil
+}
+
+// drainArchive reads the rest of an archive past the end of its tar stream,
+// so that a hash of the compressed bytes covers the whole file.
+func drainArchive(zstdReader *zstd.Decoder, compressed io.Reader) error {
+	if _, err := io.Copy(io.Discard, zstdReader); err != nil {
+		return err
+	}
+
+	zstdReader.Close()
+
+	_, err := io.Copy(io.Discard, compressed)
+
+	return err
+}
+
+// Files lists the paths the archive will place in the root without
+// extracting it, in the same form ScanFiles produces from an extracted
+// package. File hashes are not computed.
+func (a *Archive) Files() ([]DBFile, error) {
+	pkg := a.Package
+
+	if err := CheckFiles(pkg); err != nil {
+		return nil, err
+	}
+	entries := a.headers
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	targets := make([]string, 0, len(pkg.Files))
+	for k := range pkg.Files {
+		targets = append(targets, k)
+	}
+
+	sort.Strings(targets)
+
+	var files []DBFile
+
+	for _, k := range targets {
+		source := path.Clean(filepath.ToSlash(pkg.Files[k]))
+		target := path.Clean(filepath.ToSlash(k))
+
+		header, ok := entries[source]
+		if ok && header.Typeflag != tar.TypeDir {
+			files = append(files, archiveFile(target, source, header))
+			continue
+		}
+
+		found := ok
+		if ok {
+			files = append(files, archiveFile(target, source, header))
+		}
+
+		for _, name := range names {
+			if !strings.HasPrefix(name, source+"/") && source != "." {
+				continue
+			}
+
+			if name == source {
+				continue
+			}
+
+			relative := strings.TrimPrefix(name, source+"/")
+			if source == "." {
+				relative = name
+			}
+
+			files = append(files, archiveFile(path.Join(target, relative), name, entries[name]))
+			found = true
+		}
+
+		if !found {
+			return nil, &ErrorString{S: "File source " + pkg.Files[k] + " for " + k + " not found in " + a.Path}
+		}
+	}
+
+	return files, nil
+}
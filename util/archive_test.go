@@ -0,0 +1,208 @@
+package util
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadArchive(t *testing.T) {
+	dir := t.TempDir()
+
+	archive := buildTestPackage(t, dir, "tool", `spec = 1
+[package]
+name = "tool"
+version = "1.2.0"
+[files]
+"bin/tool" = "bin/tool"
+"share/tool" = "share"
+`, map[string]string{"bin/tool": "#!/bin/sh\n", "share/a": "a", "share/b/c": "c"})
+
+	read, err := ReadArchive(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := HashFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read.Hash != hash {
+		t.Errorf("got hash %s, want %s", read.Hash, hash)
+	}
+
+	if read.Package.Package.Name != "tool" || read.Package.Package.Version != "1.2.0" {
+		t.Errorf("got package %s@%s, want tool@1.2.0", read.Package.Package.Name, read.Package.Package.Version)
+	}
+
+	files, err := read.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+
+	want := []string{"bin/tool", "share/tool", "share/tool/a", "share/tool/b", "share/tool/b/c"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("got files %v, want %v", paths, want)
+	}
+}
+
+// benchmarkArchive builds a package with a few megabytes of incompressible
+// data, like the large toolchain packages the single-pass install is for.
+func benchmarkArchive(b *testing.B) string {
+	dir := b.TempDir()
+
+	data := make([]byte, 16<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	archive := buildTestPackage(b, dir, "big", `spec = 1
+[package]
+name = "big"
+version = "1.0.0"
+[files]
+"lib/big" = "lib/big"
+`, map[string]string{"lib/big": string(data)})
+
+	info, err := os.Stat(archive)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(info.Size())
+	b.ResetTimer()
+
+	return archive
+}
+
+// BenchmarkExtractArchive is the single read Install makes of an archive:
+// hashed, extracted and its package.toml read from the extracted tree.
+func BenchmarkExtractArchive(b *testing.B) {
+	archive := benchmarkArchive(b)
+	env := testEnv(b)
+
+	for i := 0; i < b.N; i++ {
+		if err := RunTransaction(env, func(tx *Transaction) error {
+			if _, err := ExtractArchive(tx, archive, ExtractOptions{}); err != nil {
+				return err
+			}
+
+			// Failing rolls the extraction back for the next iteration.
+			return errBenchmarkRollback
+		}); err != errBenchmarkRollback {
+			b.Fatal(err)
+		}
+	}
+}
+
+var errBenchmarkRollback = &ErrorString{S: "rollback"}
+
+// BenchmarkInstallMultiple installs a package end to end, from the archive
+// file to the committed transaction. Run it against an older tree to compare
+// install pipelines.
+func BenchmarkInstallMultiple(b *testing.B) {
+	archive := benchmarkArchive(b)
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		env := testEnv(b)
+		b.StartTimer()
+
+		if err := InstallMultiple(env, []string{archive}, []string{"big"}, InstallOptions{Signatures: SignatureOff}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	dir := t.TempDir()
+
+	file := buildTestPackage(t, dir, "tool", `spec = 1
+[package]
+name = "tool"
+version = "1.0.0"
+[files]
+"bin/tool" = "bin/tool"
+`, map[string]string{"bin/tool": "tool"})
+
+	hash, err := HashFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := testEnv(t)
+	var store string
+
+	err = RunTransaction(env, func(tx *Transaction) error {
+		archive, err := ExtractArchive(tx, file, ExtractOptions{})
+		if err != nil {
+			return err
+		}
+
+		if archive.Hash != hash {
+			t.Errorf("got hash %s, want %s", archive.Hash, hash)
+		}
+
+		if archive.Package.Package.Name != "tool" {
+			t.Errorf("got package %s, want tool", archive.Package.Package.Name)
+		}
+
+		files, err := archive.Files()
+		if err != nil {
+			return err
+		}
+
+		if len(files) != 1 || files[0].Path != "bin/tool" {
+			t.Errorf("got files %v, want bin/tool", files)
+		}
+
+		store = archive.store
+
+		if content, err := os.ReadFile(filepath.Join(store, "bin", "tool")); err != nil || string(content) != "tool" {
+			t.Errorf("got extracted bin/tool %q (%v), want tool", content, err)
+		}
+
+		return errBenchmarkRollback
+	})
+
+	if err != errBenchmarkRollback {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(store); !os.IsNotExist(err) {
+		t.Errorf("rollback left the extracted store %s behind", store)
+	}
+}
+
+func TestInstallMultipleRollsBackExtraction(t *testing.T) {
+	dir := t.TempDir()
+
+	file := buildTestPackage(t, dir, "tool", `spec = 1
+[package]
+name = "tool"
+version = "1.0.0"
+[dependencies]
+required = ["missing"]
+`, nil)
+
+	env := testEnv(t)
+
+	if err := InstallMultiple(env, []string{file}, []string{"tool"}, InstallOptions{Signatures: SignatureOff}); err == nil {
+		t.Fatal("installed a package with a missing dependency")
+	}
+
+	stores, err := os.ReadDir(filepath.Join(env.Root, "packages"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	if len(stores) != 0 {
+		t.Errorf("got stores %v, want none", stores)
+	}
+}
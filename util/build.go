@@ -0,0 +1,221 @@
+package util
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// buildEpoch is the modification time written into every archive entry so
+// that building the same tree twice produces byte-identical packages.
+var buildEpoch = time.Unix(0, 0)
+
+func ValidatePackageSource(source string, pkg *PackageRoot) error {
+	if pkg.Package.Name == "" {
+		return &ErrorString{S: "package.toml is missing package.name"}
+	}
+
+	if pkg.Package.Version == "" {
+		return &ErrorString{S: "package.toml is missing package.version"}
+	}
+
+	if err := CheckFiles(pkg); err != nil {
+		return err
+	}
+
+	check := func(kind string, name string) error {
+		full := filepath.Join(source, name)
+
+		relative, err := filepath.Rel(source, full)
+		if err != nil {
+			return err
+		}
+
+		if relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return &ErrorString{S: kind + " " + name + " is outside of the package directory"}
+		}
+
+		if _, err := os.Lstat(full); err != nil {
+			if os.IsNotExist(err) {
+				return &ErrorString{S: kind + " " + name + " does not exist"}
+			}
+
+			return err
+		}
+
+		return nil
+	}
+
+	for target, file := range pkg.Files {
+		if err := check("File source for "+target, file); err != nil {
+			return err
+		}
+	}
+
+	hooks := map[string]string{
+		"preinstall":  pkg.Hooks.Preinstall,
+		"postinstall": pkg.Hooks.Postinstall,
+		"preremove":   pkg.Hooks.Preremove,
+		"postremove":  pkg.Hooks.Postremove,
+		"preupgrade":  pkg.Hooks.Preupgrade,
+		"postupgrade": pkg.Hooks.Postupgrade,
+	}
+
+	for name, hook := range hooks {
+		if hook == "" {
+			continue
+		}
+
+		if err := check("Hook "+name, hook); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func BuildPackage(source string, output string) (*PackageRoot, error) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err = filepath.Abs(output)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg, err := ParsePackageFile(filepath.Join(source, "package.toml"))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ValidatePackageSource(source, pkg); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writePackageArchive(source, output, file); err != nil {
+		file.Close()
+		os.Remove(output)
+		return nil, err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(output)
+		return nil, err
+	}
+
+	return pkg, nil
+}
+
+func writePackageArchive(source string, output string, writer io.Writer) error {
+	zstdWriter, err := zstd.NewWriter(writer, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+
+	tarWriter := tar.NewWriter(zstdWriter)
+
+	// package.toml always comes first so that InspectPackage finds it
+	// without having to read through the rest of the archive.
+	if err := addArchiveEntry(tarWriter, source, "package.toml"); err != nil {
+		return err
+	}
+
+	if err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == source || path == output {
+			return nil
+		}
+
+		relative, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+
+		if relative == "package.toml" {
+			return nil
+		}
+
+		return addArchiveEntry(tarWriter, source, relative)
+	}); err != nil {
+		return err
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+
+	return zstdWriter.Close()
+}
+
+func addArchiveEntry(tarWriter *tar.Writer, source string, relative string) error {
+	path := filepath.Join(source, relative)
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	link := ""
+	if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+		link, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	} else if !info.IsDir() && !info.Mode().IsRegular() {
+		return &ErrorString{S: "Unsupported file type for " + relative}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+
+	header.Name = filepath.ToSlash(relative)
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	header.Format = tar.FormatPAX
+	header.ModTime = buildEpoch
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.Uid = 0
+	header.Gid = 0
+	header.Uname = ""
+	header.Gname = ""
+
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(tarWriter, file); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,224 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// writeBuildSource writes a package source directory with the given
+// package.toml and files.
+func writeBuildSource(t *testing.T, manifest string, files map[string]string) string {
+	t.Helper()
+
+	source := t.TempDir()
+
+	for path, content := range files {
+		full := filepath.Join(source, filepath.FromSlash(path))
+
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(full, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(source, "package.toml"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return source
+}
+
+// archiveEntries lists the names of the entries of a package archive in
+// order.
+func archiveEntries(t *testing.T, archive string) []string {
+	t.Helper()
+
+	file, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	zstdReader, err := zstd.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zstdReader.Close()
+
+	tarReader := tar.NewReader(zstdReader)
+
+	var names []string
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return names
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		names = append(names, header.Name)
+	}
+}
+
+const buildTestManifest = `spec = 1
+[package]
+name = "tool"
+version = "1.0.0"
+[files]
+"bin/tool" = "bin/tool"
+[hooks]
+postinstall = "hooks/postinstall"
+`
+
+func TestBuildPackage(t *testing.T) {
+	source := writeBuildSource(t, buildTestManifest, map[string]string{
+		"a-first/notes":     "sorted before package.toml",
+		"bin/tool":          "#!/bin/sh\n",
+		"hooks/postinstall": "#!/bin/sh\n",
+	})
+
+	// The archive is written into the source directory it is built from
+	// and must not end up in itself.
+	output := filepath.Join(source, "tool.apkg")
+
+	pkg, err := BuildPackage(source, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pkg.Package.Name != "tool" || pkg.Package.Version != "1.0.0" {
+		t.Errorf("got %s@%s, want tool@1.0.0", pkg.Package.Name, pkg.Package.Version)
+	}
+
+	entries := archiveEntries(t, output)
+
+	if len(entries) == 0 || entries[0] != "package.toml" {
+		t.Fatalf("got entries %v, want package.toml first", entries)
+	}
+
+	for _, entry := range entries {
+		if entry == "tool.apkg" {
+			t.Error("the archive contains itself")
+		}
+	}
+
+	inspected, err := InspectPackage(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inspected.Package.Name != "tool" || inspected.Files["bin/tool"] != "bin/tool" {
+		t.Errorf("InspectPackage read back %+v", inspected)
+	}
+}
+
+func TestBuildPackageIsDeterministic(t *testing.T) {
+	source := writeBuildSource(t, buildTestManifest, map[string]string{
+		"bin/tool":          "#!/bin/sh\n",
+		"hooks/postinstall": "#!/bin/sh\n",
+	})
+
+	first := filepath.Join(t.TempDir(), "first.apkg")
+	if _, err := BuildPackage(source, first); err != nil {
+		t.Fatal(err)
+	}
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(source, "bin", "tool"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	second := filepath.Join(t.TempDir(), "second.apkg")
+	if _, err := BuildPackage(source, second); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(a, b) {
+		t.Error("building the same tree twice produced different archives")
+	}
+}
+
+func TestBuildPackageValidation(t *testing.T) {
+	files := map[string]string{"bin/tool": "#!/bin/sh\n", "hooks/postinstall": "#!/bin/sh\n"}
+
+	tests := []struct {
+		name     string
+		manifest string
+		files    map[string]string
+		wantErr  string
+	}{
+		{
+			name:     "missing name",
+			manifest: strings.Replace(buildTestManifest, `name = "tool"`, "", 1),
+			files:    files,
+			wantErr:  "package.toml is missing package.name",
+		},
+		{
+			name:     "missing version",
+			manifest: strings.Replace(buildTestManifest, `version = "1.0.0"`, "", 1),
+			files:    files,
+			wantErr:  "package.toml is missing package.version",
+		},
+		{
+			name:     "missing file source",
+			manifest: buildTestManifest,
+			files:    map[string]string{"hooks/postinstall": "#!/bin/sh\n"},
+			wantErr:  "File source for bin/tool bin/tool does not exist",
+		},
+		{
+			name:     "missing hook",
+			manifest: buildTestManifest,
+			files:    map[string]string{"bin/tool": "#!/bin/sh\n"},
+			wantErr:  "Hook postinstall hooks/postinstall does not exist",
+		},
+		{
+			name:     "hook outside the source",
+			manifest: strings.Replace(buildTestManifest, `"hooks/postinstall"`, `"../postinstall"`, 1),
+			files:    files,
+			wantErr:  "Hook postinstall ../postinstall is outside of the package directory",
+		},
+		{
+			name:     "absolute files target",
+			manifest: strings.Replace(buildTestManifest, `"bin/tool" = `, `"/bin/tool" = `, 1),
+			files:    files,
+			wantErr:  `Refusing [files] entry "/bin/tool" = "bin/tool": target is an absolute path`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := writeBuildSource(t, test.manifest, test.files)
+			output := filepath.Join(t.TempDir(), "tool.apkg")
+
+			if _, err := BuildPackage(source, output); err == nil || err.Error() != test.wantErr {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+
+			if _, err := os.Lstat(output); !os.IsNotExist(err) {
+				t.Error("a failed build left an archive behind")
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package util
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// FileConflict is a path in the root that more than one package wants to
+// own. Owner is the installed package, the other package in the same batch,
+// or empty when the path exists on disk without belonging to any package.
+type FileConflict struct {
+	Path    string
+	Package string
+	Owner   string
+}
+
+func (c FileConflict) String() string {
+	if c.Owner == "" {
+		return c.Path + ": " + c.Package + " would overwrite a file not owned by any package"
+	}
+
+	return c.Path + ": provided by both " + c.Package + " and " + c.Owner
+}
+
+func archiveFile(target string, source string, header *tar.Header) DBFile {
+	file := DBFile{
+		Path:   target,
+		Source: source,
+		Type:   FileTypeFile,
+		Mode:   formatMode(header.FileInfo().Mode().Perm()),
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		file.Type = FileTypeDir
+	case tar.TypeSymlink:
+		file.Type = FileTypeSymlink
+	}
+
+	return file
+}
+
+// CheckConflicts reports every path that a package in the batch would place
+// in the root although another package in the batch, an installed package or
+// an unowned file already occupies it. A package may take over paths from
+// the packages it lists in replaces; an installed package is never in
+// conflict with the package of the same name it is being upgraded from.
+func CheckConflicts(root string, db *Database, batch map[string]*PackageRoot, batchFiles map[string][]DBFile) ([]FileConflict, error) {
+	owners := make(map[string]string)
+
+	for name, dbPackage := range db.Packages {
+		files, err := installedFiles(root, dbPackage)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			if file.Type != FileTypeDir {
+				owners[file.Path] = name
+			}
+		}
+	}
+
+	names := make([]string, 0, len(batch))
+	for name := range batch {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var conflicts []FileConflict
+	claimed := make(map[string]string)
+
+	for _, name := range names {
+		for _, file := range batchFiles[name] {
+			if file.Type == FileTypeDir {
+				if info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(file.Path))); err == nil && !info.IsDir() {
+					conflicts = append(conflicts, FileConflict{Path: file.Path, Package: name, Owner: owners[file.Path]})
+				}
+
+				continue
+			}
+
+			if other, ok := claimed[file.Path]; ok {
+				if !replaces(batch[name], other) && !replaces(batch[other], name) {
+					conflicts = append(conflicts, FileConflict{Path: file.Path, Package: name, Owner: other})
+				}
+
+				continue
+			}
+
+			claimed[file.Path] = name
+
+			if owner, ok := owners[file.Path]; ok {
+				if owner != name && !replaces(batch[name], owner) {
+					conflicts = append(conflicts, FileConflict{Path: file.Path, Package: name, Owner: owner})
+				}
+
+				continue
+			}
+
+			if _, err := os.Lstat(filepath.Join(root, filepath.FromSlash(file.Path))); err == nil {
+				conflicts = append(conflicts, FileConflict{Path: file.Path, Package: name})
+			}
+		}
+	}
+
+	return conflicts, nil
+}
+
+func replaces(pkg *PackageRoot, name string) bool {
+	if pkg == nil {
+		return false
+	}
+
+	for _, replaced := range pkg.Replaces {
+		if replaced == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckPackageConflicts fails with every file conflict between the given
+// package archives and the installed packages.
+func CheckPackageConflicts(root string, db *Database, archives []*Archive) error {
+	batch := make(map[string]*PackageRoot)
+	batchFiles := make(map[string][]DBFile)
+
+	for _, archive := range archives {
+		files, err := archive.Files()
+		if err != nil {
+			return err
+		}
+
+		batch[archive.Package.Package.Name] = archive.Package
+		batchFiles[archive.Package.Package.Name] = files
+	}
+
+	conflicts, err := CheckConflicts(root, db, batch, batchFiles)
+	if err != nil {
+		return err
+	}
+
+	if len(conflicts) != 0 {
+		return &ConflictError{Conflicts: conflicts}
+	}
+
+	return nil
+}
+
+// replaceFiles takes over the files pkg replaces from installed packages
+// before its own files are linked into the root.
+func replaceFiles(tx *Transaction, pkg *PackageRoot, files []DBFile) error {
+	if len(pkg.Replaces) == 0 {
+		return nil
+	}
+
+	tx.dbLock.Lock()
+	defer tx.dbLock.Unlock()
+
+	db, err := ReadDatabase(tx.env)
+	if err != nil {
+		return err
+	}
+
+	if err := takeOverFiles(tx, db, pkg, files); err != nil {
+		return err
+	}
+
+	return tx.WriteDatabase(db)
+}
+
+// takeOverFiles unlinks the files that pkg replaces from the installed
+// packages that own them, and drops those paths from the owners' file lists
+// in db so that removing the old owner later leaves them alone.
+func takeOverFiles(tx *Transaction, db *Database, pkg *PackageRoot, files []DBFile) error {
+	taken := make(map[string]bool)
+	for _, file := range files {
+		if file.Type != FileTypeDir {
+			taken[file.Path] = true
+		}
+	}
+
+	for _, name := range pkg.Replaces {
+		dbPackage, ok := db.Packages[name]
+		if !ok || name == pkg.Package.Name {
+			continue
+		}
+
+		owned, err := installedFiles(tx.Root, dbPackage)
+		if err != nil {
+			return err
+		}
+
+		var kept []DBFile
+
+		for _, file := range owned {
+			if !taken[file.Path] {
+				kept = append(kept, file)
+				continue
+			}
+
+			target := filepath.Join(tx.Root, filepath.FromSlash(file.Path))
+			source := filepath.Join(tx.Root, "packages", dbPackage.Hash, filepath.FromSlash(file.Source))
+
+			if _, err := os.Lstat(target); err == nil {
+				if err := tx.Remove(target, source); err != nil {
+					return err
+				}
+			}
+		}
+
+		if kept == nil {
+			kept = []DBFile{}
+		}
+
+		dbPackage.Files = kept
+		db.Packages[name] = dbPackage
+	}
+
+	return nil
+}
@@ -1,8 +1,11 @@
 package util
 
 import (
+	"bytes"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/BurntSushi/toml"
 )
@@ -12,33 +15,117 @@ type Database struct {
 }
 
 type DBPackage struct {
-	Hash         string       `toml:"hash"`
-	Package      Package      `toml:"package"`
-	Dependencies Dependencies `toml:"dependencies"`
+	Hash         string       `toml:"hash" json:"hash"`
+	Reason       string       `toml:"reason" json:"reason"`
+	Package      Package      `toml:"package" json:"package"`
+	Dependencies Dependencies `toml:"dependencies" json:"dependencies"`
+	Files        []DBFile     `toml:"files" json:"files,omitempty"`
+
+	// Dirs are the directories, relative to the root, that installing the
+	// package created to hold its files. Removing the package prunes the
+	// ones that are left empty.
+	Dirs []string `toml:"dirs,omitempty" json:"dirs,omitempty"`
+}
+
+// Why a package is installed: it was asked for, or it was pulled in by a
+// package that requires it. Packages installed before reasons were recorded
+// count as explicit.
+const (
+	ReasonExplicit   = "explicit"
+	ReasonDependency = "dependency"
+)
+
+// databaseBackups is the number of previous database generations kept as
+// db.toml.1 (newest) through db.toml.N next to the database.
+const databaseBackups = 3
+
+func databasePath(root string, generation int) string {
+	if generation == 0 {
+		return filepath.Join(root, "db.toml")
+	}
+
+	return filepath.Join(root, "db.toml."+strconv.Itoa(generation))
 }
 
-func ReadDatabase(root string) (*Database, error) {
+// ReadDatabase reads the database in the root. When db.toml is corrupt, or
+// empty or missing while backups exist, as a crash in the middle of writing
+// it can leave it, the newest backup that decodes is read instead. Putting
+// the backup back in place is left to LockDatabase, which does so under the
+// exclusive lock.
+func ReadDatabase(env *Env) (*Database, error) {
+	root := env.Root
+
 	if err := os.MkdirAll(root, 0755); err != nil {
 		return nil, err
 	}
 
-	_, err := os.Stat(filepath.Join(root, "db.toml"))
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return nil, err
-		} else {
-			file, err := os.Create(filepath.Join(root, "db.toml"))
-			if err != nil {
-				return nil, err
-			}
-
-			file.Close()
+	db, generation, err := loadDatabase(root)
+	if generation == 0 {
+		return db, err
+	}
+
+	env.warn(databasePath(root, 0) + " is " + databaseProblem(err) + ", using " + databasePath(root, generation))
+
+	return db, nil
+}
+
+// errEmptyDatabase is what decoding a zero-length database generation fails
+// with.
+var errEmptyDatabase = &ErrorString{S: "empty file"}
+
+// loadDatabase decodes db.toml, falling back to the newest backup that
+// decodes when db.toml doesn't. It returns the generation it read and, for
+// a backup, why db.toml wasn't used. Without any backup a missing or empty
+// db.toml is a root nothing was installed into yet.
+func loadDatabase(root string) (*Database, int, error) {
+	db, err := decodeGeneration(root, 0)
+	if err == nil {
+		return db, 0, nil
+	}
+
+	for generation := 1; generation <= databaseBackups; generation++ {
+		if backup, backupErr := decodeGeneration(root, generation); backupErr == nil {
+			return backup, generation, err
 		}
 	}
 
+	if os.IsNotExist(err) || err == errEmptyDatabase {
+		return &Database{Packages: make(map[string]DBPackage)}, 0, nil
+	}
+
+	return nil, 0, err
+}
+
+func decodeGeneration(root string, generation int) (*Database, error) {
+	info, err := os.Stat(databasePath(root, generation))
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		return nil, errEmptyDatabase
+	}
+
+	return decodeDatabase(databasePath(root, generation))
+}
+
+// databaseProblem describes why loadDatabase didn't use db.toml.
+func databaseProblem(err error) string {
+	if os.IsNotExist(err) {
+		return "missing"
+	}
+
+	if err == errEmptyDatabase {
+		return "empty"
+	}
+
+	return "corrupt (" + err.Error() + ")"
+}
+
+func decodeDatabase(path string) (*Database, error) {
 	var db Database
 
-	if _, err := toml.DecodeFile(filepath.Join(root, "db.toml"), &db); err != nil {
+	if _, err := toml.DecodeFile(path, &db); err != nil {
 		return nil, err
 	}
 
@@ -46,60 +133,162 @@ func ReadDatabase(root string) (*Database, error) {
 		db.Packages = make(map[string]DBPackage)
 	}
 
+	for name, pkg := range db.Packages {
+		if pkg.Reason == "" {
+			pkg.Reason = ReasonExplicit
+			db.Packages[name] = pkg
+		}
+	}
+
 	return &db, nil
 }
 
-func WriteDatabase(root string, db *Database) error {
+// restoreDatabase puts the backup ReadDatabase would fall back to in place
+// of a corrupt, empty or missing db.toml, which is moved aside to
+// db.toml.corrupt. The database has to be locked exclusively.
+func restoreDatabase(env *Env) error {
+	root := env.Root
+
+	_, generation, err := loadDatabase(root)
+	if generation == 0 {
+		return nil
+	}
+
+	env.warn(databasePath(root, 0) + " is " + databaseProblem(err) + ", restoring " + databasePath(root, generation))
+
+	if err := os.Rename(databasePath(root, 0), filepath.Join(root, "db.toml.corrupt")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return writeFileAtomic(databasePath(root, 0), func(file *os.File) error {
+		backup, err := os.Open(databasePath(root, generation))
+		if err != nil {
+			return err
+		}
+		defer backup.Close()
+
+		_, err = io.Copy(file, backup)
+		return err
+	})
+}
+
+// databaseDamaged reports whether restoreDatabase has a backup to restore.
+func databaseDamaged(root string) bool {
+	_, generation, _ := loadDatabase(root)
+
+	return generation != 0
+}
+
+// WriteDatabase replaces the database atomically: the new contents are
+// written and synced to a temporary file that is renamed over db.toml, after
+// the previous generation has been rotated into the backups. Inside a
+// transaction use Transaction.WriteDatabase, which leaves the rotation to
+// Commit.
+func WriteDatabase(env *Env, db *Database) error {
+	root := env.Root
+
 	if err := os.MkdirAll(root, 0755); err != nil {
 		return err
 	}
 
-	file, err := os.OpenFile(filepath.Join(root, "db.toml"), os.O_TRUNC|os.O_WRONLY, 0644)
+	return writeDatabase(root, db, true)
+}
+
+func writeDatabase(root string, db *Database, rotate bool) error {
+	var contents bytes.Buffer
+
+	if err := toml.NewEncoder(&contents).Encode(db); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(databasePath(root, 0), func(file *os.File) error {
+		if _, err := file.Write(contents.Bytes()); err != nil {
+			return err
+		}
+
+		if !rotate {
+			return nil
+		}
+
+		return rotateDatabase(root, databasePath(root, 0), contents.Bytes())
+	})
+}
+
+// rotateDatabase shifts the backups up by one generation and makes previous,
+// the database as it was before the change being made, the newest backup.
+// Nothing is rotated when previous is missing or empty, or holds the same
+// contents as current, the database after the change.
+func rotateDatabase(root string, previous string, current []byte) error {
+	contents, err := os.ReadFile(previous)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
 		return err
 	}
 
-	defer file.Close()
+	if len(contents) == 0 || bytes.Equal(contents, current) {
+		return nil
+	}
 
-	if err := toml.NewEncoder(file).Encode(db); err != nil {
+	for generation := databaseBackups; generation > 1; generation-- {
+		if err := os.Rename(databasePath(root, generation-1), databasePath(root, generation)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// The newest backup is a hardlink to the previous database, which keeps
+	// its contents once the new database is renamed over it.
+	if err := os.Remove(databasePath(root, 1)); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
-	return nil
+	return os.Link(previous, databasePath(root, 1))
 }
 
-func LockDatabase(root string) error {
-	if err := os.MkdirAll(root, 0755); err != nil {
+// writeFileAtomic writes to a temporary file next to path and, once the
+// contents have been written and synced, renames it into place and syncs the
+// directory so the rename itself survives a crash.
+func writeFileAtomic(path string, write func(file *os.File) error) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
 		return err
 	}
+	defer os.Remove(file.Name())
 
-	_, err := os.Stat(filepath.Join(root, "db.lock"))
-	if err == nil {
-		return &ErrorString{"Database already locked"}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
 	}
 
-	if !os.IsNotExist(err) {
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
 		return err
 	}
 
-	file, err := os.Create(filepath.Join(root, "db.lock"))
-	if err != nil {
+	if err := file.Sync(); err != nil {
+		file.Close()
 		return err
 	}
 
-	defer file.Close()
+	if err := file.Close(); err != nil {
+		return err
+	}
 
-	return nil
+	if err := os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
 }
 
-func UnlockDatabase(root string) error {
-	if err := os.MkdirAll(root, 0755); err != nil {
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
 		return err
 	}
-	
-	if err := os.Remove(filepath.Join(root, "db.lock")); err != nil {
-		return nil
-	}
+	defer dir.Close()
 
-	return nil
+	return dir.Sync()
 }
@@ -0,0 +1,191 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDatabaseBackupsRotatePerTransaction(t *testing.T) {
+	dir := t.TempDir()
+	env := testEnv(t)
+
+	manifest := func(name string) string {
+		return "spec = 1\n[package]\nname = \"" + name + "\"\nversion = \"1.0.0\"\n"
+	}
+
+	a := buildTestPackage(t, dir, "a", manifest("a"), nil)
+	b := buildTestPackage(t, dir, "b", manifest("b"), nil)
+	c := buildTestPackage(t, dir, "c", manifest("c"), nil)
+
+	if err := InstallMultiple(env, []string{a}, []string{"a"}, InstallOptions{Signatures: SignatureOff}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Installing b and c writes the database several times, but rotates the
+	// backups only once.
+	if err := InstallMultiple(env, []string{b, c}, []string{"b", "c"}, InstallOptions{Signatures: SignatureOff}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		generation int
+		want       []string
+	}{
+		{generation: 0, want: []string{"a", "b", "c"}},
+		{generation: 1, want: []string{"a"}},
+	}
+
+	for _, test := range tests {
+		db, err := decodeDatabase(databasePath(env.Root, test.generation))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := []string{}
+		for name := range db.Packages {
+			got = append(got, name)
+		}
+
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s has %v, want %v", databasePath(env.Root, test.generation), got, test.want)
+		}
+	}
+
+	// The first transaction started without a database, so there was
+	// nothing to back up.
+	if _, err := os.Stat(databasePath(env.Root, 2)); !os.IsNotExist(err) {
+		t.Errorf("%s exists after two transactions", databasePath(env.Root, 2))
+	}
+}
+
+func TestDatabaseBackupsSkipUnchangedAndEmpty(t *testing.T) {
+	env := testEnv(t)
+
+	db := &Database{Packages: map[string]DBPackage{"a": installedPackage("a", "1.0.0")}}
+
+	if err := WriteDatabase(env, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transaction that writes the same database, like a repair that found
+	// nothing to do, keeps the backups as they are.
+	if err := RunTransaction(env, func(tx *Transaction) error {
+		return tx.WriteDatabase(db)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteDatabase(env, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(databasePath(env.Root, 1)); !os.IsNotExist(err) {
+		t.Errorf("%s exists although the database never changed", databasePath(env.Root, 1))
+	}
+
+	// An empty database is never kept as a backup.
+	if err := os.WriteFile(databasePath(env.Root, 0), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteDatabase(env, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(databasePath(env.Root, 1)); !os.IsNotExist(err) {
+		t.Errorf("%s exists after replacing an empty database", databasePath(env.Root, 1))
+	}
+}
+
+func TestReadDatabaseFallsBackToBackup(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary []byte
+		missing bool
+		backups bool
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty with backups", primary: []byte{}, backups: true, want: []string{"a"}},
+		{name: "missing with backups", missing: true, backups: true, want: []string{"a"}},
+		{name: "corrupt with backups", primary: []byte("[package\n"), backups: true, want: []string{"a"}},
+		{name: "empty without backups", primary: []byte{}, want: []string{}},
+		{name: "missing without backups", missing: true, want: []string{}},
+		{name: "corrupt without backups", primary: []byte("[package\n"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := testEnv(t)
+
+			if test.backups {
+				if err := os.WriteFile(databasePath(env.Root, 2), []byte("[package.a]\nhash = \"h\"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+
+				// Zero-length generations are passed over.
+				if err := os.WriteFile(databasePath(env.Root, 1), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !test.missing {
+				if err := os.WriteFile(databasePath(env.Root, 0), test.primary, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			db, err := ReadDatabase(env)
+
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("read a corrupt database without backups")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for name := range db.Packages {
+				got = append(got, name)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got packages %v, want %v", got, test.want)
+			}
+
+			// Reading doesn't change anything; locking restores the backup.
+			if _, err := os.Stat(filepath.Join(env.Root, "db.toml.corrupt")); !os.IsNotExist(err) {
+				t.Errorf("ReadDatabase moved db.toml aside")
+			}
+
+			lock, err := LockDatabase(env, false, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lock.Unlock()
+
+			restored, err := decodeGeneration(env.Root, 0)
+
+			if test.backups {
+				if err != nil || len(restored.Packages) != 1 {
+					t.Errorf("got restored database %v (%v), want the backup", restored, err)
+				}
+			} else if test.missing {
+				if !os.IsNotExist(err) {
+					t.Errorf("locking created db.toml without a backup to restore: %v", err)
+				}
+			}
+		})
+	}
+}
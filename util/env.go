@@ -0,0 +1,107 @@
+package util
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+)
+
+type HookPolicy string
+
+const (
+	HooksRun  HookPolicy = "run"
+	HooksSkip HookPolicy = "skip"
+)
+
+// ParseHookPolicy checks a hook policy given on the command line.
+func ParseHookPolicy(policy string) (HookPolicy, error) {
+	switch HookPolicy(policy) {
+	case HooksRun, HooksSkip:
+		return HookPolicy(policy), nil
+	}
+
+	return "", &ErrorString{S: "Unknown hook policy " + policy + ", expected run or skip"}
+}
+
+// Env is what an operation on a root needs besides the root itself: the
+// context that cancels it, the standard streams hooks run with, whether
+// hooks run at all and where warnings are logged. Operations that read the
+// database, run hooks or log take an Env; unset fields fall back to the
+// background context, the process's standard streams and a logger on
+// Stderr.
+type Env struct {
+	Root    string
+	Context context.Context
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	Hooks  HookPolicy
+	Logger *log.Logger
+}
+
+// WithContext returns a copy of the Env that runs under ctx.
+func (e *Env) WithContext(ctx context.Context) *Env {
+	copied := *e
+	copied.Context = ctx
+
+	return &copied
+}
+
+func (e *Env) context() context.Context {
+	if e.Context == nil {
+		return context.Background()
+	}
+
+	return e.Context
+}
+
+// cancelled returns the context's error once the operation was cancelled.
+func (e *Env) cancelled() error {
+	return e.context().Err()
+}
+
+func (e *Env) stdin() io.Reader {
+	if e.Stdin == nil {
+		return os.Stdin
+	}
+
+	return e.Stdin
+}
+
+func (e *Env) stdout() io.Writer {
+	if e.Stdout == nil {
+		return os.Stdout
+	}
+
+	return e.Stdout
+}
+
+func (e *Env) stderr() io.Writer {
+	if e.Stderr == nil {
+		return os.Stderr
+	}
+
+	return e.Stderr
+}
+
+func (e *Env) warn(message string) {
+	e.log("Warning: " + message)
+}
+
+// notice logs something that needs no action, like an optional dependency
+// that is skipped.
+func (e *Env) notice(message string) {
+	e.log("Note: " + message)
+}
+
+func (e *Env) log(line string) {
+	if e.Logger != nil {
+		e.Logger.Println(line)
+		return
+	}
+
+	log.New(e.stderr(), "", 0).Println(line)
+}
@@ -1,5 +1,10 @@
 package util
 
+import (
+	"strconv"
+	"strings"
+)
+
 type ErrorString struct {
 	S string
 }
@@ -7,3 +12,154 @@ type ErrorString struct {
 func (e *ErrorString) Error() string {
 	return e.S
 }
+
+// NotFoundError is returned when a package, key, repository or path owner
+// that an operation refers to doesn't exist. Kind is "Package", "Key",
+// "Repository" or "Owner".
+type NotFoundError struct {
+	Kind string
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Kind == "Owner" {
+		return "No package owns " + e.Name
+	}
+
+	return e.Kind + " doesn't exist: " + e.Name
+}
+
+// AlreadyInstalledError is returned when installing a package that is
+// already installed. Version is set when the exact same version is.
+type AlreadyInstalledError struct {
+	Name    string
+	Version string
+}
+
+func (e *AlreadyInstalledError) Error() string {
+	if e.Version != "" {
+		return "Package " + e.Name + "@" + e.Version + " is already installed"
+	}
+
+	return "Package is already installed with name " + e.Name
+}
+
+// ConstraintError is returned when a dependency constraint can't be met.
+// Found is the version of Package that was found, and is empty when no
+// version was found at all. Detail, when set, replaces the default message
+// with a longer explanation, such as the requirements the resolver couldn't
+// satisfy together.
+type ConstraintError struct {
+	Package    string
+	Constraint string
+	Found      string
+	Detail     string
+}
+
+func (e *ConstraintError) Error() string {
+	if e.Detail != "" {
+		return e.Detail
+	}
+
+	if e.Found == "" {
+		if e.Constraint == "" {
+			return "Dependency not found: " + e.Package
+		}
+
+		return "Dependency not found: " + e.Package + "@" + e.Constraint
+	}
+
+	return "Version constraint for package " + e.Package + " not met. Required " + e.Constraint + ", found " + e.Found
+}
+
+// CycleError is returned when packages require each other in a cycle, so
+// that none of them can be installed before the others. Packages lists the
+// cycle in order, starting and ending with the same package.
+type CycleError struct {
+	Packages []string
+}
+
+func (e *CycleError) Error() string {
+	return "Dependency cycle: " + strings.Join(e.Packages, " -> ")
+}
+
+// DependentsError is returned when removing a package would leave installed
+// packages without a package they require. Dependents are those packages.
+type DependentsError struct {
+	Package    string
+	Dependents []string
+}
+
+func (e *DependentsError) Error() string {
+	if len(e.Dependents) == 1 {
+		return "Package " + e.Dependents[0] + " depends on " + e.Package
+	}
+
+	return "Packages " + strings.Join(e.Dependents, ", ") + " depend on " + e.Package
+}
+
+// LockedError is returned when another process holds the database lock. PID
+// is zero when the holder is unknown.
+type LockedError struct {
+	PID int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID != 0 {
+		return "Database already locked by PID " + strconv.Itoa(e.PID)
+	}
+
+	return "Database already locked"
+}
+
+// ConflictError is returned when packages would overwrite each other's files
+// or files not owned by any package.
+type ConflictError struct {
+	Conflicts []FileConflict
+}
+
+func (e *ConflictError) Error() string {
+	lines := []string{"File conflicts:"}
+
+	for _, conflict := range e.Conflicts {
+		lines = append(lines, "  "+conflict.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// HookError is returned when a package hook fails. ExitStatus is the hook's
+// exit status, or -1 when it couldn't be run or was killed by a signal.
+type HookError struct {
+	Package    string
+	Hook       string
+	ExitStatus int
+	Err        error
+}
+
+func (e *HookError) Error() string {
+	if e.ExitStatus >= 0 {
+		return "The " + e.Hook + " hook of " + e.Package + " failed with exit status " + strconv.Itoa(e.ExitStatus)
+	}
+
+	return "The " + e.Hook + " hook of " + e.Package + " failed: " + e.Err.Error()
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// RollbackError is returned when a transaction failed and rolling it back
+// failed as well. It unwraps to the error the transaction failed with.
+type RollbackError struct {
+	Err      error
+	Rollback error
+}
+
+func (e *RollbackError) Error() string {
+	return e.Err.Error() + "\n" + e.Rollback.Error()
+}
+
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,306 @@
+package util
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ExtractOptions relaxes the rules ExtractPackage enforces on archive
+// entries and bounds the resources extraction may use. By default device
+// nodes and setuid or setgid bits are refused. A limit of zero means no
+// limit; sizes are uncompressed bytes.
+type ExtractOptions struct {
+	AllowDevices bool
+	AllowSetuid  bool
+
+	MaxTotalSize int64
+	MaxFileSize  int64
+	MaxEntries   int
+	MaxDepth     int
+}
+
+// ExtractError is returned when an archive entry breaks the rules that keep
+// extraction confined to the installation directory.
+type ExtractError struct {
+	Entry  string
+	Reason string
+}
+
+func (e *ExtractError) Error() string {
+	return "Refusing to extract " + e.Entry + ": " + e.Reason
+}
+
+// ExtractPackage extracts a package archive into target. Every entry,
+// hardlink target and parent directory has to stay inside target: absolute
+// paths and paths leaving it are refused, as is writing through a symlink
+// created by an earlier entry or extracting the same path twice. The limits
+// in options are checked while streaming through the archive. When
+// extraction fails target is removed again, along with whatever was already
+// extracted into it.
+func ExtractPackage(tarball string, target string, options ExtractOptions) error {
+	_, err := ExtractPackageHash(tarball, target, options)
+
+	return err
+}
+
+// ExtractPackageHash extracts a package archive like ExtractPackage and
+// returns the sha256 hash of the archive, computed from the same read.
+func ExtractPackageHash(tarball string, target string, options ExtractOptions) (string, error) {
+	hash, err := extractArchive(tarball, target, options, nil)
+	if err != nil {
+		os.RemoveAll(target)
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// extractArchive extracts tarball into target and returns its hash. When
+// headers isn't nil the header of every entry is recorded in it by its
+// cleaned path.
+func extractArchive(tarball string, target string, options ExtractOptions, headers map[string]*tar.Header) (string, error) {
+	reader, err := os.Open(tarball)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	tee := io.TeeReader(reader, hasher)
+
+	zstdReader, err := zstd.NewReader(tee)
+	if err != nil {
+		return "", err
+	}
+	defer zstdReader.Close()
+	tarReader := tar.NewReader(zstdReader)
+
+	entries := 0
+	var total int64
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		entries++
+		if options.MaxEntries > 0 && entries > options.MaxEntries {
+			return "", &ExtractError{Entry: header.Name, Reason: "archive has more than " + strconv.Itoa(options.MaxEntries) + " entries"}
+		}
+
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			if options.MaxFileSize > 0 && header.Size > options.MaxFileSize {
+				return "", &ExtractError{Entry: header.Name, Reason: "file is larger than " + strconv.FormatInt(options.MaxFileSize, 10) + " bytes"}
+			}
+
+			total += header.Size
+			if options.MaxTotalSize > 0 && total > options.MaxTotalSize {
+				return "", &ExtractError{Entry: header.Name, Reason: "archive is larger than " + strconv.FormatInt(options.MaxTotalSize, 10) + " bytes uncompressed"}
+			}
+		}
+
+		if err := extractEntry(tarReader, header, target, options); err != nil {
+			return "", err
+		}
+
+		if headers != nil {
+			headers[path.Clean(header.Name)] = header
+		}
+	}
+
+	if err := drainArchive(zstdReader, tee); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// entryPath cleans the slash separated path of an archive entry and checks
+// that it stays inside the installation directory.
+func entryPath(name string) (string, string) {
+	if name == "" {
+		return "", "empty path"
+	}
+
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) {
+		return "", "absolute path"
+	}
+
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", "path leaves the package directory"
+	}
+
+	return cleaned, ""
+}
+
+// makeParents creates the missing parent directories of name inside target,
+// refusing to pass through anything but real directories. entry is the
+// archive entry being extracted, for the error.
+func makeParents(target string, entry string, name string) error {
+	parent := path.Dir(name)
+	if parent == "." {
+		return nil
+	}
+
+	current := ""
+
+	for _, component := range strings.Split(parent, "/") {
+		current = path.Join(current, component)
+		full := filepath.Join(target, filepath.FromSlash(current))
+
+		info, err := os.Lstat(full)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(full, 0755); err != nil {
+				return err
+			}
+
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+			return &ExtractError{Entry: entry, Reason: "path passes through the symlink " + current}
+		}
+
+		if !info.IsDir() {
+			return &ExtractError{Entry: entry, Reason: current + " is not a directory"}
+		}
+	}
+
+	return nil
+}
+
+func extractEntry(tarReader *tar.Reader, header *tar.Header, target string, options ExtractOptions) error {
+	refuse := func(reason string) error {
+		return &ExtractError{Entry: header.Name, Reason: reason}
+	}
+
+	name, reason := entryPath(header.Name)
+	if reason != "" {
+		return refuse(reason)
+	}
+
+	if depth := strings.Count(name, "/") + 1; options.MaxDepth > 0 && depth > options.MaxDepth {
+		return refuse("path is deeper than " + strconv.Itoa(options.MaxDepth) + " levels")
+	}
+
+	info := header.FileInfo()
+	mode := info.Mode()
+
+	if mode&(os.ModeSetuid|os.ModeSetgid) != 0 && !options.AllowSetuid {
+		return refuse("setuid and setgid bits are not allowed")
+	}
+
+	if name == "." {
+		if header.Typeflag == tar.TypeDir {
+			return nil
+		}
+
+		return refuse("not a directory")
+	}
+
+	if err := makeParents(target, header.Name, name); err != nil {
+		return err
+	}
+
+	full := filepath.Join(target, filepath.FromSlash(name))
+
+	exists := func(err error) error {
+		if os.IsExist(err) {
+			return refuse("duplicate entry")
+		}
+
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		existing, err := os.Lstat(full)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(full, mode.Perm()); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else if !existing.IsDir() {
+			return refuse("duplicate entry")
+		}
+
+		return os.Chmod(full, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	case tar.TypeReg, tar.TypeRegA:
+		file, err := os.OpenFile(full, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, mode.Perm())
+		if err != nil {
+			return exists(err)
+		}
+
+		// The tar reader never returns more than header.Size bytes, which
+		// the limits were checked against.
+		if _, err := io.Copy(file, tarReader); err != nil {
+			file.Close()
+			return err
+		}
+
+		if err := file.Close(); err != nil {
+			return err
+		}
+
+		if mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) != 0 {
+			return os.Chmod(full, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		}
+
+		return nil
+	case tar.TypeSymlink:
+		return exists(os.Symlink(header.Linkname, full))
+	case tar.TypeLink:
+		linkName, reason := entryPath(header.Linkname)
+		if reason != "" {
+			return refuse("hardlink target " + header.Linkname + ": " + reason)
+		}
+
+		if err := makeParents(target, header.Name, linkName); err != nil {
+			return err
+		}
+
+		source, err := os.Lstat(filepath.Join(target, filepath.FromSlash(linkName)))
+		if err != nil || !source.Mode().IsRegular() {
+			return refuse("hardlink target " + header.Linkname + " is not a regular file in the package")
+		}
+
+		return exists(os.Link(filepath.Join(target, filepath.FromSlash(linkName)), full))
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if !options.AllowDevices {
+			return refuse("device nodes are not allowed")
+		}
+
+		kind := uint32(syscall.S_IFIFO)
+		if header.Typeflag == tar.TypeChar {
+			kind = syscall.S_IFCHR
+		} else if header.Typeflag == tar.TypeBlock {
+			kind = syscall.S_IFBLK
+		}
+
+		return exists(syscall.Mknod(full, kind|uint32(mode.Perm()), deviceNumber(header.Devmajor, header.Devminor)))
+	default:
+		return refuse("unsupported entry type " + string(header.Typeflag))
+	}
+}
+
+// deviceNumber encodes a device number the way glibc's makedev does.
+func deviceNumber(major int64, minor int64) int {
+	return int((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
@@ -0,0 +1,196 @@
+package util
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// testEntry is an entry of an archive written by writeTestArchive. Entries
+// with a trailing slash are directories.
+type testEntry struct {
+	name    string
+	content string
+}
+
+// writeTestArchive writes a zstd-compressed tar archive with the given
+// entries to dir.
+func writeTestArchive(t *testing.T, dir string, entries []testEntry) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "test.apkg")
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	zstdWriter, err := zstd.NewWriter(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tarWriter := tar.NewWriter(zstdWriter)
+
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(entry.content))}
+		if strings.HasSuffix(entry.name, "/") {
+			header = &tar.Header{Name: entry.name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tarWriter.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := zstdWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestExtractPackageLimits(t *testing.T) {
+	entries := []testEntry{
+		{name: "package.toml", content: "spec = 1\n"},
+		{name: "bin/"},
+		{name: "bin/tool", content: strings.Repeat("x", 100)},
+		{name: "share/doc/tool/README", content: strings.Repeat("y", 50)},
+	}
+
+	tests := []struct {
+		name       string
+		options    ExtractOptions
+		wantReason string
+	}{
+		{name: "no limits"},
+		{name: "within limits", options: ExtractOptions{MaxTotalSize: 200, MaxFileSize: 100, MaxEntries: 4, MaxDepth: 4}},
+		{name: "too many entries", options: ExtractOptions{MaxEntries: 3}, wantReason: "archive has more than 3 entries"},
+		{name: "file too large", options: ExtractOptions{MaxFileSize: 99}, wantReason: "file is larger than 99 bytes"},
+		{name: "archive too large", options: ExtractOptions{MaxTotalSize: 150}, wantReason: "archive is larger than 150 bytes uncompressed"},
+		{name: "path too deep", options: ExtractOptions{MaxDepth: 3}, wantReason: "path is deeper than 3 levels"},
+	}
+
+	archive := writeTestArchive(t, t.TempDir(), entries)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "store")
+			if err := os.Mkdir(target, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := ExtractPackage(archive, target, test.options)
+
+			if test.wantReason == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if content, err := os.ReadFile(filepath.Join(target, "share", "doc", "tool", "README")); err != nil || len(content) != 50 {
+					t.Errorf("got README %q (%v), want 50 bytes", content, err)
+				}
+
+				return
+			}
+
+			var extractErr *ExtractError
+			if !errors.As(err, &extractErr) || extractErr.Reason != test.wantReason {
+				t.Fatalf("got error %v, want %q", err, test.wantReason)
+			}
+
+			if _, err := os.Lstat(target); !os.IsNotExist(err) {
+				t.Errorf("the partial extraction %s was left behind", target)
+			}
+		})
+	}
+}
+
+func TestExtractPackageRefusesEscapes(t *testing.T) {
+	tests := []struct {
+		name       string
+		entries    []testEntry
+		wantReason string
+	}{
+		{name: "absolute path", entries: []testEntry{{name: "/etc/passwd", content: "x"}}},
+		{name: "parent directory", entries: []testEntry{{name: "../outside", content: "x"}}},
+		{name: "duplicate entry", entries: []testEntry{{name: "a", content: "x"}, {name: "a", content: "y"}}, wantReason: "duplicate entry"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			archive := writeTestArchive(t, dir, test.entries)
+			target := filepath.Join(dir, "store")
+			if err := os.Mkdir(target, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := ExtractPackage(archive, target, ExtractOptions{})
+
+			var extractErr *ExtractError
+			if !errors.As(err, &extractErr) {
+				t.Fatalf("got error %v, want an ExtractError", err)
+			}
+
+			if test.wantReason != "" && extractErr.Reason != test.wantReason {
+				t.Errorf("got reason %q, want %q", extractErr.Reason, test.wantReason)
+			}
+
+			if _, err := os.Lstat(filepath.Join(dir, "outside")); !os.IsNotExist(err) {
+				t.Error("extraction wrote outside of the target")
+			}
+
+			if _, err := os.Lstat(target); !os.IsNotExist(err) {
+				t.Errorf("the partial extraction %s was left behind", target)
+			}
+		})
+	}
+}
+
+func TestInstallMultipleRemovesStoreOverLimit(t *testing.T) {
+	file := buildTestPackage(t, t.TempDir(), "big", `spec = 1
+[package]
+name = "big"
+version = "1.0.0"
+[files]
+"lib/big" = "big"
+`, map[string]string{"big": strings.Repeat("x", 1024)})
+
+	env := testEnv(t)
+	options := InstallOptions{Signatures: SignatureOff, Extract: ExtractOptions{MaxFileSize: 512}}
+
+	err := InstallMultiple(env, []string{file}, []string{"big"}, options)
+
+	var extractErr *ExtractError
+	if !errors.As(err, &extractErr) {
+		t.Fatalf("got error %v, want an ExtractError", err)
+	}
+
+	stores, err := os.ReadDir(filepath.Join(env.Root, "packages"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	if len(stores) != 0 {
+		t.Errorf("got stores %v, want none", stores)
+	}
+
+	if _, err := os.Lstat(filepath.Join(env.Root, "lib", "big")); !os.IsNotExist(err) {
+		t.Error("lib/big was installed")
+	}
+}
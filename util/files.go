@@ -0,0 +1,291 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DBFile is one path a package placed in the root. Path is relative to the
+// root and Source to the package's store directory, both slash separated.
+type DBFile struct {
+	Path   string `toml:"path" json:"path"`
+	Source string `toml:"source" json:"source"`
+	Type   string `toml:"type" json:"type"`
+	Mode   string `toml:"mode" json:"mode"`
+	Hash   string `toml:"hash,omitempty" json:"hash,omitempty"`
+}
+
+const (
+	FileTypeFile    = "file"
+	FileTypeDir     = "dir"
+	FileTypeSymlink = "symlink"
+)
+
+func (f DBFile) FileMode() os.FileMode {
+	mode, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil {
+		return 0
+	}
+
+	return os.FileMode(mode)
+}
+
+func formatMode(mode os.FileMode) string {
+	return "0" + strconv.FormatUint(uint64(mode), 8)
+}
+
+// FilesError is returned when an entry of a package's [files] table would
+// link a path outside of the root, or take its source from outside of the
+// package.
+type FilesError struct {
+	Target string
+	Source string
+	Reason string
+}
+
+func (e *FilesError) Error() string {
+	return "Refusing [files] entry " + strconv.Quote(e.Target) + " = " + strconv.Quote(e.Source) + ": " + e.Reason
+}
+
+// CheckFiles checks that every target and source in the package's [files]
+// table is a relative path without .. components.
+func CheckFiles(pkg *PackageRoot) error {
+	targets := make([]string, 0, len(pkg.Files))
+	for target := range pkg.Files {
+		targets = append(targets, target)
+	}
+
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		source := pkg.Files[target]
+
+		if reason := filesPathProblem(target); reason != "" {
+			return &FilesError{Target: target, Source: source, Reason: "target is " + reason}
+		}
+
+		if reason := filesPathProblem(source); reason != "" {
+			return &FilesError{Target: target, Source: source, Reason: "source is " + reason}
+		}
+	}
+
+	return nil
+}
+
+func filesPathProblem(name string) string {
+	if name == "" {
+		return "an empty path"
+	}
+
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) {
+		return "an absolute path"
+	}
+
+	for _, component := range strings.Split(filepath.ToSlash(name), "/") {
+		if component == ".." {
+			return "a path with .. in it"
+		}
+	}
+
+	return ""
+}
+
+func newDBFile(path string, source string, full string) (DBFile, error) {
+	info, err := os.Lstat(full)
+	if err != nil {
+		return DBFile{}, err
+	}
+
+	file := DBFile{
+		Path:   filepath.ToSlash(filepath.Clean(path)),
+		Source: filepath.ToSlash(filepath.Clean(source)),
+		Mode:   formatMode(info.Mode().Perm()),
+	}
+
+	switch {
+	case info.IsDir():
+		file.Type = FileTypeDir
+	case info.Mode()&os.ModeSymlink == os.ModeSymlink:
+		file.Type = FileTypeSymlink
+	case !info.Mode().IsRegular():
+		// Device nodes and fifos are linked like files, but reading them
+		// to compute a hash could block or have side effects.
+		file.Type = FileTypeFile
+	default:
+		file.Type = FileTypeFile
+
+		file.Hash, err = HashFile(full)
+		if err != nil {
+			return DBFile{}, err
+		}
+	}
+
+	return file, nil
+}
+
+// ScanFiles lists every path the package's [files] table places in the root,
+// reading the file details from the extracted package in pkgPath. Directories
+// are listed before their contents.
+func ScanFiles(pkgPath string, pkg *PackageRoot) ([]DBFile, error) {
+	if err := CheckFiles(pkg); err != nil {
+		return nil, err
+	}
+
+	targets := make([]string, 0, len(pkg.Files))
+	for k := range pkg.Files {
+		targets = append(targets, k)
+	}
+
+	sort.Strings(targets)
+
+	var files []DBFile
+
+	for _, k := range targets {
+		v := pkg.Files[k]
+
+		info, err := os.Stat(filepath.Join(pkgPath, v))
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			file, err := newDBFile(k, v, filepath.Join(pkgPath, v))
+			if err != nil {
+				return nil, err
+			}
+
+			files = append(files, file)
+			continue
+		}
+
+		if err := filepath.Walk(filepath.Join(pkgPath, v), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			relative, err := filepath.Rel(filepath.Join(pkgPath, v), path)
+			if err != nil {
+				return err
+			}
+
+			file, err := newDBFile(filepath.Join(k, relative), filepath.Join(v, relative), path)
+			if err != nil {
+				return err
+			}
+
+			files = append(files, file)
+
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// PackageFiles returns the files an installed package placed in the root.
+// Packages installed before the file index existed are scanned from their
+// store directory instead.
+func PackageFiles(env *Env, name string) ([]DBFile, error) {
+	installed, err := ListInstalled(env)
+	if err != nil {
+		return nil, err
+	}
+
+	dbPackage, ok := installed[name]
+	if !ok {
+		return nil, &NotFoundError{Kind: "Package", Name: name}
+	}
+
+	return installedFiles(env.Root, dbPackage)
+}
+
+func installedFiles(root string, dbPackage DBPackage) ([]DBFile, error) {
+	if dbPackage.Files != nil {
+		return dbPackage.Files, nil
+	}
+
+	installationPath := filepath.Join(root, "packages", dbPackage.Hash)
+
+	pkg, err := ParsePackageFile(filepath.Join(installationPath, "package.toml"))
+	if err != nil {
+		return nil, err
+	}
+
+	return ScanFiles(installationPath, pkg)
+}
+
+// RootRelative turns a path given on the command line into a slash separated
+// path relative to the root. Absolute paths, and relative paths that point
+// into the root from the working directory, are resolved against the root;
+// any other relative path is taken to already be relative to the root.
+func RootRelative(root string, path string) (string, error) {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	absoluteRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+
+	relative, err := filepath.Rel(absoluteRoot, absolute)
+	if err != nil {
+		return "", err
+	}
+
+	if relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		if filepath.IsAbs(path) {
+			return "", &ErrorString{S: path + " is not inside the root " + root}
+		}
+
+		return filepath.ToSlash(filepath.Clean(path)), nil
+	}
+
+	return filepath.ToSlash(relative), nil
+}
+
+// FindOwners returns the names of the installed packages that placed path in
+// the root. Directories can be owned by several packages.
+func FindOwners(env *Env, path string) ([]string, error) {
+	root := env.Root
+
+	relative, err := RootRelative(root, path)
+	if err != nil {
+		return nil, err
+	}
+
+	installed, err := ListInstalled(env)
+	if err != nil {
+		return nil, err
+	}
+
+	var owners []string
+
+	for name, dbPackage := range installed {
+		files, err := installedFiles(root, dbPackage)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			if file.Path == relative {
+				owners = append(owners, name)
+				break
+			}
+		}
+	}
+
+	if len(owners) == 0 {
+		return nil, &NotFoundError{Kind: "Owner", Name: path}
+	}
+
+	sort.Strings(owners)
+
+	return owners, nil
+}
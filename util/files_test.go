@@ -0,0 +1,272 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{
+			name:  "relative paths",
+			files: map[string]string{"bin/tool": "bin/tool", "share/tool": "share", ".": "root"},
+		},
+		{
+			name:    "target leaving the root",
+			files:   map[string]string{"../../etc/x": "x"},
+			wantErr: `Refusing [files] entry "../../etc/x" = "x": target is a path with .. in it`,
+		},
+		{
+			name:    "absolute target",
+			files:   map[string]string{"/etc/x": "x"},
+			wantErr: `Refusing [files] entry "/etc/x" = "x": target is an absolute path`,
+		},
+		{
+			name:    "target with .. inside",
+			files:   map[string]string{"bin/../../x": "x"},
+			wantErr: `Refusing [files] entry "bin/../../x" = "x": target is a path with .. in it`,
+		},
+		{
+			name:    "source leaving the package",
+			files:   map[string]string{"bin/x": "../../../etc/passwd"},
+			wantErr: `Refusing [files] entry "bin/x" = "../../../etc/passwd": source is a path with .. in it`,
+		},
+		{
+			name:    "absolute source",
+			files:   map[string]string{"bin/x": "/etc/passwd"},
+			wantErr: `Refusing [files] entry "bin/x" = "/etc/passwd": source is an absolute path`,
+		},
+		{
+			name:    "empty target",
+			files:   map[string]string{"": "x"},
+			wantErr: `Refusing [files] entry "" = "x": target is an empty path`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := CheckFiles(&PackageRoot{Files: test.files})
+
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			if err == nil || err.Error() != test.wantErr {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestInstallRefusesFilesOutsideRoot(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "evil")
+
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(source, "x"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// BuildPackage refuses this package.toml, so the archive is written
+	// directly.
+	if err := os.WriteFile(filepath.Join(source, "package.toml"), []byte(`spec = 1
+[package]
+name = "evil"
+version = "1.0.0"
+[files]
+"../escaped" = "x"
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(dir, "evil.apkg")
+
+	file, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writePackageArchive(source, archive, file); err != nil {
+		t.Fatal(err)
+	}
+
+	file.Close()
+
+	env := testEnv(t)
+	env.Root = filepath.Join(dir, "root")
+
+	err = InstallMultiple(env, []string{archive}, []string{"evil"}, InstallOptions{Signatures: SignatureOff})
+
+	var filesErr *FilesError
+	if !errors.As(err, &filesErr) || filesErr.Target != "../escaped" {
+		t.Fatalf("got error %v, want a FilesError for ../escaped", err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("../escaped was linked outside of the root")
+	}
+
+	if _, err := BuildPackage(source, filepath.Join(dir, "built.apkg")); !errors.As(err, &filesErr) {
+		t.Errorf("got error %v from BuildPackage, want a FilesError", err)
+	}
+}
+
+// installOwnedPackages installs two packages that share the directory
+// etc/tool.d into a new root.
+func installOwnedPackages(t *testing.T) *Env {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	tool := buildTestPackage(t, dir, "tool", `spec = 1
+[package]
+name = "tool"
+version = "1.0.0"
+[files]
+"bin/tool" = "tool"
+"etc/tool.d" = "conf"
+`, map[string]string{"tool": "#!/bin/sh\n", "conf/tool.conf": "a"})
+
+	plugin := buildTestPackage(t, dir, "plugin", `spec = 1
+[package]
+name = "plugin"
+version = "1.0.0"
+[files]
+"etc/tool.d" = "conf"
+`, map[string]string{"conf/plugin.conf": "b"})
+
+	env := testEnv(t)
+
+	if err := InstallMultiple(env, []string{tool, plugin}, []string{"tool", "plugin"}, InstallOptions{Signatures: SignatureOff}); err != nil {
+		t.Fatal(err)
+	}
+
+	return env
+}
+
+func TestPackageFiles(t *testing.T) {
+	env := installOwnedPackages(t)
+
+	files, err := PackageFiles(env, "tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func(path string) string {
+		hash, err := HashFile(filepath.Join(env.Root, filepath.FromSlash(path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return hash
+	}
+
+	want := []DBFile{
+		{Path: "bin/tool", Source: "tool", Type: FileTypeFile, Mode: "0644", Hash: hash("bin/tool")},
+		{Path: "etc/tool.d", Source: "conf", Type: FileTypeDir, Mode: "0755"},
+		{Path: "etc/tool.d/tool.conf", Source: "conf/tool.conf", Type: FileTypeFile, Mode: "0644", Hash: hash("etc/tool.d/tool.conf")},
+	}
+
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got files %+v, want %+v", files, want)
+	}
+
+	if _, err := PackageFiles(env, "missing"); err == nil {
+		t.Error("listed the files of a package that isn't installed")
+	}
+}
+
+func TestPackageFilesScansLegacyPackages(t *testing.T) {
+	env := installOwnedPackages(t)
+
+	db, err := ReadDatabase(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := db.Packages["tool"].Files
+
+	// Packages installed before the file index existed have no files in
+	// the database.
+	pkg := db.Packages["tool"]
+	pkg.Files = nil
+	db.Packages["tool"] = pkg
+
+	if err := WriteDatabase(env, db); err != nil {
+		t.Fatal(err)
+	}
+
+	scanned, err := PackageFiles(env, "tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(scanned, recorded) {
+		t.Errorf("scanned %+v, want the recorded %+v", scanned, recorded)
+	}
+}
+
+func TestFindOwners(t *testing.T) {
+	env := installOwnedPackages(t)
+
+	tests := []struct {
+		name         string
+		path         string
+		want         []string
+		wantNotFound bool
+		wantErr      bool
+	}{
+		{name: "relative to the root", path: "bin/tool", want: []string{"tool"}},
+		{name: "absolute", path: filepath.Join(env.Root, "bin", "tool"), want: []string{"tool"}},
+		{name: "uncleaned", path: "bin/../bin//tool", want: []string{"tool"}},
+		{name: "shared directory", path: "etc/tool.d", want: []string{"plugin", "tool"}},
+		{name: "file in a shared directory", path: "etc/tool.d/plugin.conf", want: []string{"plugin"}},
+		{name: "not owned", path: "bin", wantNotFound: true},
+		{name: "outside the root", path: filepath.Join(t.TempDir(), "bin", "tool"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			owners, err := FindOwners(env, test.path)
+
+			var notFound *NotFoundError
+			if test.wantNotFound {
+				if !errors.As(err, &notFound) {
+					t.Fatalf("got owners %v and error %v, want a NotFoundError", owners, err)
+				}
+
+				return
+			}
+
+			if test.wantErr {
+				if err == nil || errors.As(err, &notFound) {
+					t.Fatalf("got owners %v and error %v, want a path error", owners, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(owners, test.want) {
+				t.Errorf("got owners %v, want %v", owners, test.want)
+			}
+		})
+	}
+}
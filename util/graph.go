@@ -0,0 +1,159 @@
+package util
+
+import (
+	"sort"
+)
+
+// DependencyGraph is the dependency graph of a set of packages, as an
+// adjacency list sorted by package name.
+type DependencyGraph struct {
+	Packages []GraphNode `toml:"packages" json:"packages"`
+}
+
+// GraphNode is a package in a DependencyGraph. File is set for packages
+// read from an archive rather than from the database.
+type GraphNode struct {
+	Name         string      `toml:"name" json:"name"`
+	Version      string      `toml:"version" json:"version"`
+	File         string      `toml:"file,omitempty" json:"file,omitempty"`
+	Dependencies []GraphEdge `toml:"dependencies" json:"dependencies"`
+}
+
+// GraphEdge is a dependency of a GraphNode. Version is the version of the
+// dependency in the graph and is empty when the graph doesn't contain it;
+// Satisfied is set when it does, in a version that meets Constraint.
+type GraphEdge struct {
+	Name       string `toml:"name" json:"name"`
+	Constraint string `toml:"constraint,omitempty" json:"constraint,omitempty"`
+	Optional   bool   `toml:"optional" json:"optional"`
+	Version    string `toml:"version,omitempty" json:"version,omitempty"`
+	Satisfied  bool   `toml:"satisfied" json:"satisfied"`
+}
+
+// Node returns the package with the given name, or nil.
+func (g *DependencyGraph) Node(name string) *GraphNode {
+	i := sort.Search(len(g.Packages), func(i int) bool {
+		return g.Packages[i].Name >= name
+	})
+
+	if i < len(g.Packages) && g.Packages[i].Name == name {
+		return &g.Packages[i]
+	}
+
+	return nil
+}
+
+// Roots returns the packages no other package in the graph depends on. When
+// every package is part of a cycle, all of them are returned.
+func (g *DependencyGraph) Roots() []*GraphNode {
+	dependedOn := make(map[string]bool)
+
+	for _, node := range g.Packages {
+		for _, edge := range node.Dependencies {
+			if edge.Name != node.Name {
+				dependedOn[edge.Name] = true
+			}
+		}
+	}
+
+	var roots []*GraphNode
+
+	for i := range g.Packages {
+		if !dependedOn[g.Packages[i].Name] {
+			roots = append(roots, &g.Packages[i])
+		}
+	}
+
+	if len(roots) == 0 {
+		for i := range g.Packages {
+			roots = append(roots, &g.Packages[i])
+		}
+	}
+
+	return roots
+}
+
+// BuildGraph builds the dependency graph of the installed packages or, when
+// packageFiles isn't empty, of those package archives together with the
+// installed packages they depend on, directly or through other packages.
+// Dependencies are looked up among the archives first.
+func BuildGraph(env *Env, packageFiles []string) (*DependencyGraph, error) {
+	installed, err := ListInstalled(env)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]*GraphNode)
+	dependencies := make(map[string]Dependencies)
+
+	add := func(node GraphNode, deps Dependencies) {
+		nodes[node.Name] = &node
+		dependencies[node.Name] = deps
+	}
+
+	if len(packageFiles) == 0 {
+		for name, pkg := range installed {
+			add(GraphNode{Name: name, Version: pkg.Package.Version}, pkg.Dependencies)
+		}
+	} else {
+		var queue []string
+
+		for _, file := range packageFiles {
+			pkg, err := InspectPackage(file)
+			if err != nil {
+				return nil, err
+			}
+
+			add(GraphNode{Name: pkg.Package.Name, Version: pkg.Package.Version, File: file}, pkg.Dependencies)
+			queue = append(queue, pkg.Package.Name)
+		}
+
+		for len(queue) != 0 {
+			deps := dependencies[queue[0]]
+			queue = queue[1:]
+
+			for _, dependency := range append(append([]string{}, deps.Required...), deps.Optional...) {
+				name, _ := SplitDependency(dependency)
+
+				if pkg, ok := installed[name]; ok && nodes[name] == nil {
+					add(GraphNode{Name: name, Version: pkg.Package.Version}, pkg.Dependencies)
+					queue = append(queue, name)
+				}
+			}
+		}
+	}
+
+	graph := &DependencyGraph{Packages: []GraphNode{}}
+
+	for name, node := range nodes {
+		node.Dependencies = []GraphEdge{}
+
+		for _, dependency := range dependencies[name].Required {
+			node.Dependencies = append(node.Dependencies, graphEdge(nodes, dependency, false))
+		}
+
+		for _, dependency := range dependencies[name].Optional {
+			node.Dependencies = append(node.Dependencies, graphEdge(nodes, dependency, true))
+		}
+
+		graph.Packages = append(graph.Packages, *node)
+	}
+
+	sort.Slice(graph.Packages, func(i, j int) bool {
+		return graph.Packages[i].Name < graph.Packages[j].Name
+	})
+
+	return graph, nil
+}
+
+func graphEdge(nodes map[string]*GraphNode, dependency string, optional bool) GraphEdge {
+	name, constraint := SplitDependency(dependency)
+	edge := GraphEdge{Name: name, Constraint: constraint, Optional: optional}
+
+	if node, ok := nodes[name]; ok {
+		edge.Version = node.Version
+		edge.Satisfied = checkConstraint(name, constraint, node.Version) == nil
+	}
+
+	return edge
+}
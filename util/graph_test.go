@@ -0,0 +1,132 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+// graphTestEnv installs app, which requires lib in a version that isn't
+// installed and optionally depends on docs, which isn't installed at all.
+func graphTestEnv(t *testing.T) *Env {
+	t.Helper()
+
+	app := installedPackage("app", "1.0.0", "lib@^2.0")
+	app.Dependencies.Optional = []string{"docs"}
+
+	env := testEnv(t)
+	testDatabase(t, env, []DBPackage{
+		app,
+		installedPackage("lib", "1.0.0", "core@^1.0"),
+		installedPackage("core", "1.2.0"),
+		installedPackage("other", "1.0.0"),
+	})
+
+	return env
+}
+
+func graphNames(nodes []*GraphNode) []string {
+	names := []string{}
+
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+
+	return names
+}
+
+func TestBuildGraphInstalled(t *testing.T) {
+	graph, err := BuildGraph(graphTestEnv(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &DependencyGraph{Packages: []GraphNode{
+		{Name: "app", Version: "1.0.0", Dependencies: []GraphEdge{
+			{Name: "lib", Constraint: "^2.0", Version: "1.0.0"},
+			{Name: "docs", Optional: true},
+		}},
+		{Name: "core", Version: "1.2.0", Dependencies: []GraphEdge{}},
+		{Name: "lib", Version: "1.0.0", Dependencies: []GraphEdge{
+			{Name: "core", Constraint: "^1.0", Version: "1.2.0", Satisfied: true},
+		}},
+		{Name: "other", Version: "1.0.0", Dependencies: []GraphEdge{}},
+	}}
+
+	if !reflect.DeepEqual(graph, want) {
+		t.Fatalf("got %+v, want %+v", graph, want)
+	}
+
+	if got := graphNames(graph.Roots()); !reflect.DeepEqual(got, []string{"app", "other"}) {
+		t.Errorf("got roots %v, want [app other]", got)
+	}
+
+	if node := graph.Node("lib"); node == nil || node.Version != "1.0.0" {
+		t.Errorf("got node %+v for lib", node)
+	}
+
+	if node := graph.Node("docs"); node != nil {
+		t.Errorf("got node %+v for docs, which isn't in the graph", node)
+	}
+}
+
+func TestBuildGraphArchives(t *testing.T) {
+	env := graphTestEnv(t)
+
+	file := buildTestPackage(t, t.TempDir(), "tool", `spec = 1
+[package]
+name = "tool"
+version = "1.0.0"
+[dependencies]
+required = ["lib"]
+optional = ["app"]
+`, nil)
+
+	graph, err := BuildGraph(env, []string{file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the installed packages the archive leads to are part of the
+	// graph, so other is left out.
+	if got := graphNames(graph.Roots()); !reflect.DeepEqual(got, []string{"tool"}) {
+		t.Errorf("got roots %v, want [tool]", got)
+	}
+
+	names := []string{}
+	for _, node := range graph.Packages {
+		names = append(names, node.Name)
+	}
+
+	if want := []string{"app", "core", "lib", "tool"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got packages %v, want %v", names, want)
+	}
+
+	tool := graph.Node("tool")
+	if tool == nil || tool.File != file {
+		t.Fatalf("got node %+v for tool, want it read from %s", tool, file)
+	}
+
+	want := []GraphEdge{
+		{Name: "lib", Version: "1.0.0", Satisfied: true},
+		{Name: "app", Optional: true, Version: "1.0.0", Satisfied: true},
+	}
+
+	if !reflect.DeepEqual(tool.Dependencies, want) {
+		t.Errorf("got edges %+v, want %+v", tool.Dependencies, want)
+	}
+
+	if lib := graph.Node("lib"); lib == nil || lib.File != "" {
+		t.Errorf("got node %+v for lib, want it read from the database", lib)
+	}
+}
+
+func TestGraphRootsOfCycle(t *testing.T) {
+	graph := &DependencyGraph{Packages: []GraphNode{
+		{Name: "a", Dependencies: []GraphEdge{{Name: "b"}}},
+		{Name: "b", Dependencies: []GraphEdge{{Name: "a"}}},
+	}}
+
+	if got := graphNames(graph.Roots()); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("got roots %v, want [a b]", got)
+	}
+}
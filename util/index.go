@@ -0,0 +1,120 @@
+package util
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+func ReadIndex(directory string) (*RepositoryIndex, error) {
+	var index RepositoryIndex
+
+	if _, err := toml.DecodeFile(filepath.Join(directory, "index.toml"), &index); err != nil {
+		if os.IsNotExist(err) {
+			return &index, nil
+		}
+
+		return nil, err
+	}
+
+	return &index, nil
+}
+
+// GenerateIndex builds the index for a directory of package archives. Entries
+// from an existing index.toml are reused when the archive's size and
+// modification time are unchanged, so only new or modified archives are
+// inspected and hashed.
+func GenerateIndex(directory string) (*RepositoryIndex, error) {
+	previous, err := ReadIndex(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := make(map[string]IndexPackage)
+	for _, pkg := range previous.Packages {
+		cached[pkg.Path] = pkg
+	}
+
+	index := RepositoryIndex{Packages: []IndexPackage{}}
+
+	if err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".apkg") {
+			return nil
+		}
+
+		relative, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+
+		relative = filepath.ToSlash(relative)
+
+		// Signatures are read every time, since an archive can be signed
+		// after it was first indexed.
+		signature, err := ReadSignature(path)
+		if err != nil {
+			return &ErrorString{S: "Couldn't read the signature of " + relative + ": " + err.Error()}
+		}
+
+		if entry, ok := cached[relative]; ok && entry.Size == info.Size() && entry.Modified.Equal(info.ModTime()) {
+			entry.Signature = signature
+			index.Packages = append(index.Packages, entry)
+			return nil
+		}
+
+		pkg, err := InspectPackage(path)
+		if err != nil {
+			return &ErrorString{S: "Couldn't inspect " + relative + ": " + err.Error()}
+		}
+
+		hash, err := HashFile(path)
+		if err != nil {
+			return err
+		}
+
+		index.Packages = append(index.Packages, IndexPackage{
+			Name:         pkg.Package.Name,
+			Version:      pkg.Package.Version,
+			Description:  pkg.Package.Description,
+			Hash:         hash,
+			Path:         relative,
+			Size:         info.Size(),
+			Modified:     info.ModTime(),
+			Dependencies: pkg.Dependencies,
+			Signature:    signature,
+		})
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(index.Packages, func(i, j int) bool {
+		return index.Packages[i].Path < index.Packages[j].Path
+	})
+
+	return &index, nil
+}
+
+func WriteIndex(directory string, index *RepositoryIndex) error {
+	if err := writeFileAtomic(filepath.Join(directory, "index.toml"), func(file *os.File) error {
+		return toml.NewEncoder(file).Encode(index)
+	}); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(directory, "index.json"), func(file *os.File) error {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(index)
+	})
+}
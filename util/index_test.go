@@ -0,0 +1,210 @@
+package util
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// indexTestPackage builds a package archive named name-version.apkg in dir.
+func indexTestPackage(t *testing.T, dir string, name string, version string, description string) string {
+	t.Helper()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := buildTestPackage(t, t.TempDir(), name, `spec = 1
+[package]
+name = "`+name+`"
+version = "`+version+`"
+description = "`+description+`"
+[dependencies]
+required = ["core@^1.0"]
+`, nil)
+
+	path := filepath.Join(dir, name+"-"+version+".apkg")
+	if err := os.Rename(archive, path); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestGenerateIndex(t *testing.T) {
+	repository := t.TempDir()
+
+	tool := indexTestPackage(t, filepath.Join(repository, "main"), "tool", "1.0.0", "A tool")
+	lib := indexTestPackage(t, filepath.Join(repository, "extra"), "lib", "2.0.0", "A library")
+
+	if err := os.WriteFile(filepath.Join(repository, "main", "README"), []byte("not a package"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := GenerateIndex(repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(index.Packages) != 2 {
+		t.Fatalf("got %d packages, want 2", len(index.Packages))
+	}
+
+	for i, want := range []struct{ path, file, name, version, description string }{
+		{"extra/lib-2.0.0.apkg", lib, "lib", "2.0.0", "A library"},
+		{"main/tool-1.0.0.apkg", tool, "tool", "1.0.0", "A tool"},
+	} {
+		pkg := index.Packages[i]
+
+		hash, err := HashFile(want.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := os.Stat(want.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pkg.Path != want.path || pkg.Name != want.name || pkg.Version != want.version || pkg.Description != want.description {
+			t.Errorf("got %s %s@%s %q, want %s %s@%s %q", pkg.Path, pkg.Name, pkg.Version, pkg.Description, want.path, want.name, want.version, want.description)
+		}
+
+		if pkg.Hash != hash || pkg.Size != info.Size() || !pkg.Modified.Equal(info.ModTime()) {
+			t.Errorf("got hash %s, size %d and time %v for %s, want %s, %d and %v", pkg.Hash, pkg.Size, pkg.Modified, pkg.Path, hash, info.Size(), info.ModTime())
+		}
+
+		if !reflect.DeepEqual(pkg.Dependencies.Required, []string{"core@^1.0"}) {
+			t.Errorf("got dependencies %v for %s, want core@^1.0", pkg.Dependencies.Required, pkg.Path)
+		}
+	}
+
+	if err := WriteIndex(repository, index); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadIndex(repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(repository, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fromJSON RepositoryIndex
+	if err := json.Unmarshal(contents, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, written := range []*RepositoryIndex{read, &fromJSON} {
+		if len(written.Packages) != 2 || written.Packages[0].Hash != index.Packages[0].Hash || written.Packages[1].Path != index.Packages[1].Path {
+			t.Errorf("wrote %+v, want %+v", written.Packages, index.Packages)
+		}
+	}
+}
+
+func TestGenerateIndexIncremental(t *testing.T) {
+	repository := t.TempDir()
+
+	kept := indexTestPackage(t, repository, "kept", "1.0.0", "Kept")
+	changed := indexTestPackage(t, repository, "changed", "1.0.0", "Before")
+	removed := indexTestPackage(t, repository, "removed", "1.0.0", "Removed")
+
+	index, err := GenerateIndex(repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries that are reused keep what the index says about them, which
+	// shows that their archive wasn't inspected again.
+	for i := range index.Packages {
+		index.Packages[i].Description = "from the index"
+	}
+
+	if err := WriteIndex(repository, index); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(changed); err != nil {
+		t.Fatal(err)
+	}
+
+	indexTestPackage(t, repository, "changed", "1.0.0", "After")
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(changed, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	added := indexTestPackage(t, repository, "added", "1.0.0", "Added")
+
+	updated, err := GenerateIndex(repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	descriptions := make(map[string]string)
+	hashes := make(map[string]string)
+
+	for _, pkg := range updated.Packages {
+		descriptions[pkg.Name] = pkg.Description
+		hashes[pkg.Name] = pkg.Hash
+	}
+
+	want := map[string]string{"added": "Added", "changed": "After", "kept": "from the index"}
+	if !reflect.DeepEqual(descriptions, want) {
+		t.Errorf("got descriptions %v, want %v", descriptions, want)
+	}
+
+	for name, file := range map[string]string{"added": added, "changed": changed, "kept": kept} {
+		if hash, err := HashFile(file); err != nil || hashes[name] != hash {
+			t.Errorf("got hash %s for %s, want %s (%v)", hashes[name], name, hash, err)
+		}
+	}
+}
+
+func TestGenerateIndexRereadsSignatures(t *testing.T) {
+	repository := t.TempDir()
+	archive := indexTestPackage(t, repository, "tool", "1.0.0", "A tool")
+
+	index, err := GenerateIndex(repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteIndex(repository, index); err != nil {
+		t.Fatal(err)
+	}
+
+	if index.Packages[0].Signature != nil {
+		t.Fatal("got a signature for an unsigned archive")
+	}
+
+	keyPath := filepath.Join(t.TempDir(), "signing")
+	key, err := GenerateKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := SignPackage(archive, keyPath); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := GenerateIndex(repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signature := updated.Packages[0].Signature; signature == nil || signature.Key != key.Fingerprint {
+		t.Errorf("got signature %+v, want one by %s", signature, key.Fingerprint)
+	}
+}
@@ -0,0 +1,249 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DatabaseLock is a kernel-backed lock on db.lock in the root. Shared locks
+// may be held by any number of readers at once, an exclusive lock by a single
+// writer. The kernel drops the lock when the holding process dies, so a
+// crashed apkg never leaves the root locked.
+type DatabaseLock struct {
+	root      string
+	file      *os.File
+	exclusive bool
+
+	// holder is the file in the holders directory that records the PID of
+	// the process holding the lock.
+	holder string
+}
+
+// lockPollInterval is how often a waiting LockDatabase retries the lock.
+const lockPollInterval = 100 * time.Millisecond
+
+func lockHoldersPath(root string) string {
+	return filepath.Join(root, "db.lock.d")
+}
+
+// LockDatabase locks the database in the root. With a zero wait it fails
+// immediately when the lock is held elsewhere, a positive wait retries until
+// the timeout expires, and a negative wait retries until the Env is
+// cancelled. Every locker, shared or exclusive, records its PID in db.lock.d
+// so that a locked database can name the processes holding it. Taking over
+// from a process that died without unlocking finishes or rolls back the
+// transaction it left behind.
+func LockDatabase(env *Env, exclusive bool, wait time.Duration) (*DatabaseLock, error) {
+	root := env.Root
+
+	if err := os.MkdirAll(lockHoldersPath(root), 0755); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+
+	for {
+		file, err := os.OpenFile(filepath.Join(root, "db.lock"), os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		lock := &DatabaseLock{root: root, file: file}
+
+		// Readers that find an unfinished transaction or a damaged database
+		// take the lock exclusively until it has been recovered.
+		recovering := needsRecovery(root)
+
+		if err := lock.acquire(env, exclusive || recovering, wait, deadline); err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		if lock.exclusive {
+			if err := lock.recover(env); err != nil {
+				lock.release()
+				return nil, err
+			}
+
+			// flock can't turn an exclusive lock into a shared one
+			// atomically: converting drops the lock first, and a writer
+			// could take it and crash in between. The reader lets go and
+			// starts over instead, and checks the database again once it
+			// holds the shared lock.
+			if !exclusive {
+				lock.release()
+				continue
+			}
+		} else if needsRecovery(root) {
+			// A writer died between the check above and taking the lock.
+			lock.release()
+			continue
+		}
+
+		if err := lock.register(); err != nil {
+			lock.release()
+			return nil, err
+		}
+
+		return lock, nil
+	}
+}
+
+// needsRecovery reports whether the root has a transaction to finish or roll
+// back or a database to restore from a backup.
+func needsRecovery(root string) bool {
+	if _, err := os.Stat(journalPath(root)); err == nil {
+		return true
+	}
+
+	return databaseDamaged(root)
+}
+
+func (l *DatabaseLock) acquire(env *Env, exclusive bool, wait time.Duration, deadline time.Time) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	for {
+		err := syscall.Flock(int(l.file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			l.exclusive = exclusive
+			return nil
+		}
+
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+
+		if wait == 0 || (wait > 0 && time.Now().After(deadline)) {
+			if pids := holders(l.root); len(pids) != 0 {
+				return &LockedError{PID: pids[0]}
+			}
+
+			return &LockedError{}
+		}
+
+		select {
+		case <-env.context().Done():
+			return env.cancelled()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// recover cleans up after the processes that held the lock before and died
+// without unlocking: their PID files are removed, and the transaction or
+// damaged database they left behind is recovered. The lock has to be held
+// exclusively, which means no other process holds it.
+func (l *DatabaseLock) recover(env *Env) error {
+	entries, err := os.ReadDir(lockHoldersPath(l.root))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if pid := holderPID(entry.Name()); pid != 0 {
+			env.warn("recovering database lock left behind by PID " + strconv.Itoa(pid))
+		}
+
+		if err := os.Remove(filepath.Join(lockHoldersPath(l.root), entry.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if err := RecoverTransaction(l.root); err != nil {
+		return err
+	}
+
+	if err := restoreDatabase(env); err != nil {
+		return err
+	}
+
+	if needsRecovery(l.root) {
+		return &ErrorString{S: "Couldn't recover the database in " + l.root}
+	}
+
+	return nil
+}
+
+// register records the PID of this process as a holder of the lock.
+func (l *DatabaseLock) register() error {
+	file, err := os.CreateTemp(lockHoldersPath(l.root), strconv.Itoa(os.Getpid())+".*")
+	if err != nil {
+		return err
+	}
+
+	l.holder = file.Name()
+
+	return file.Close()
+}
+
+// holders returns the PIDs of the live processes recorded as holding the
+// lock, lowest first. Files left behind by processes that died are removed.
+func holders(root string) []int {
+	entries, err := os.ReadDir(lockHoldersPath(root))
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[int]bool)
+	var pids []int
+
+	for _, entry := range entries {
+		pid := holderPID(entry.Name())
+
+		if pid == 0 || !processAlive(pid) {
+			os.Remove(filepath.Join(lockHoldersPath(root), entry.Name()))
+			continue
+		}
+
+		if !seen[pid] {
+			seen[pid] = true
+			pids = append(pids, pid)
+		}
+	}
+
+	sort.Ints(pids)
+
+	return pids
+}
+
+// holderPID parses the PID a holder file is named after, or returns 0.
+func holderPID(name string) int {
+	pid, err := strconv.Atoi(strings.SplitN(name, ".", 2)[0])
+	if err != nil || pid <= 0 {
+		return 0
+	}
+
+	return pid
+}
+
+// release drops the lock without unregistering.
+func (l *DatabaseLock) release() error {
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		l.file.Close()
+		return err
+	}
+
+	return l.file.Close()
+}
+
+func (l *DatabaseLock) Unlock() error {
+	if l.holder != "" {
+		os.Remove(l.holder)
+	}
+
+	return l.release()
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+
+	return err == nil || err == syscall.EPERM
+}
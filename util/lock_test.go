@@ -0,0 +1,215 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockDatabaseContention(t *testing.T) {
+	tests := []struct {
+		name       string
+		held       bool
+		exclusive  bool
+		wantLocked bool
+	}{
+		{name: "shared with shared", held: false, exclusive: false},
+		{name: "exclusive with shared", held: false, exclusive: true, wantLocked: true},
+		{name: "shared with exclusive", held: true, exclusive: false, wantLocked: true},
+		{name: "exclusive with exclusive", held: true, exclusive: true, wantLocked: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := testEnv(t)
+
+			held, err := LockDatabase(env, test.held, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer held.Unlock()
+
+			lock, err := LockDatabase(env, test.exclusive, 0)
+
+			if !test.wantLocked {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				lock.Unlock()
+				return
+			}
+
+			var locked *LockedError
+			if !errors.As(err, &locked) {
+				t.Fatalf("got error %v, want a LockedError", err)
+			}
+
+			if locked.PID != os.Getpid() {
+				t.Errorf("got locked by PID %d, want %d", locked.PID, os.Getpid())
+			}
+		})
+	}
+}
+
+func TestLockDatabaseWait(t *testing.T) {
+	env := testEnv(t)
+
+	held, err := LockDatabase(env, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LockDatabase(env, false, 150*time.Millisecond); err == nil {
+		t.Fatal("took the lock while it was held exclusively")
+	}
+
+	time.AfterFunc(150*time.Millisecond, func() { held.Unlock() })
+
+	lock, err := LockDatabase(env, true, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Unlock()
+}
+
+// deadPID returns the PID of a process that has exited.
+func deadPID(t *testing.T) int {
+	command := exec.Command("true")
+
+	if err := command.Run(); err != nil {
+		t.Skip("can't run true: ", err)
+	}
+
+	pid := command.Process.Pid
+	if processAlive(pid) {
+		t.Skip("PID of the exited process was reused")
+	}
+
+	return pid
+}
+
+func TestLockDatabaseRecoversStaleHolders(t *testing.T) {
+	for _, exclusive := range []bool{false, true} {
+		t.Run("exclusive "+strconv.FormatBool(exclusive), func(t *testing.T) {
+			var logged bytes.Buffer
+			env := testEnv(t)
+			env.Logger = log.New(&logged, "", 0)
+
+			pid := deadPID(t)
+
+			if err := os.MkdirAll(lockHoldersPath(env.Root), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			stale := filepath.Join(lockHoldersPath(env.Root), strconv.Itoa(pid)+".1")
+			if err := os.WriteFile(stale, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// A transaction the dead process left behind, which any locker
+			// has to roll back before the database is used.
+			if err := os.MkdirAll(journalPath(env.Root), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			lock, err := LockDatabase(env, exclusive, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lock.Unlock()
+
+			if lock.exclusive != exclusive {
+				t.Errorf("got an exclusive lock %v, want %v", lock.exclusive, exclusive)
+			}
+
+			if _, err := os.Stat(stale); !os.IsNotExist(err) {
+				t.Errorf("the stale holder %s is still there", stale)
+			}
+
+			if _, err := os.Stat(journalPath(env.Root)); !os.IsNotExist(err) {
+				t.Errorf("the journal wasn't recovered")
+			}
+
+			if !strings.Contains(logged.String(), "left behind by PID "+strconv.Itoa(pid)) {
+				t.Errorf("got log %q, want a warning about PID %d", logged.String(), pid)
+			}
+		})
+	}
+}
+
+func TestLockedErrorSkipsDeadHolders(t *testing.T) {
+	env := testEnv(t)
+
+	held, err := LockDatabase(env, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Unlock()
+
+	stale := filepath.Join(lockHoldersPath(env.Root), strconv.Itoa(deadPID(t))+".1")
+	if err := os.WriteFile(stale, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LockDatabase(env, false, 0)
+
+	var locked *LockedError
+	if !errors.As(err, &locked) || locked.PID != os.Getpid() {
+		t.Fatalf("got error %v, want locked by PID %d", err, os.Getpid())
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("the stale holder %s is still there", stale)
+	}
+}
+
+func TestLockDatabaseReaderDowngradesAfterRecovery(t *testing.T) {
+	env := testEnv(t)
+
+	if err := WriteDatabase(env, &Database{Packages: map[string]DBPackage{"a": installedPackage("a", "1.0.0")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteDatabase(env, &Database{Packages: map[string]DBPackage{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(databasePath(env.Root, 0), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := LockDatabase(env, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+
+	if lock.exclusive {
+		t.Error("the reader kept the lock exclusively after recovering")
+	}
+
+	if databaseDamaged(env.Root) {
+		t.Error("the damaged database wasn't restored")
+	}
+
+	// Other readers aren't kept out once the database is recovered.
+	other, err := LockDatabase(env, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other.Unlock()
+
+	if pids := holders(env.Root); len(pids) != 1 || pids[0] != os.Getpid() {
+		t.Errorf("got holders %v, want only %d", pids, os.Getpid())
+	}
+}
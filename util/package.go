@@ -9,10 +9,9 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
-	"strings"
+	"sort"
 	"sync"
 
-	"github.com/Masterminds/semver"
 	"github.com/goombaio/dag"
 	"golang.org/x/sync/errgroup"
 
@@ -21,35 +20,36 @@ import (
 )
 
 type PackageRoot struct {
-	Spec         int               `toml:"spec"`
-	Package      Package           `toml:"package"`
-	Dependencies Dependencies      `toml:"dependencies"`
-	Files        map[string]string `toml:"files"`
-	Hooks        Hooks             `toml:"hooks"`
+	Spec         int               `toml:"spec" json:"spec"`
+	Replaces     []string          `toml:"replaces" json:"replaces"`
+	Package      Package           `toml:"package" json:"package"`
+	Dependencies Dependencies      `toml:"dependencies" json:"dependencies"`
+	Files        map[string]string `toml:"files" json:"files"`
+	Hooks        Hooks             `toml:"hooks" json:"hooks"`
 }
 
 type Package struct {
-	Name        string   `toml:"name"`
-	Description string   `toml:"description"`
-	Version     string   `toml:"version"`
-	Authors     []string `toml:"authors"`
-	Maintainers []string `toml:"maintainers"`
+	Name        string   `toml:"name" json:"name"`
+	Description string   `toml:"description" json:"description"`
+	Version     string   `toml:"version" json:"version"`
+	Authors     []string `toml:"authors" json:"authors"`
+	Maintainers []string `toml:"maintainers" json:"maintainers"`
 }
 
 type Dependencies struct {
-	Required []string `toml:"required"`
-	Optional []string `toml:"optional"`
+	Required []string `toml:"required" json:"required"`
+	Optional []string `toml:"optional" json:"optional"`
 }
 
 type Hooks struct {
-	Postinstall string `toml:"postinstall"`
-	Preinstall  string `toml:"preinstall"`
-	Postremove  string `toml:"postremove"`
-	Preremove   string `toml:"preremove"`
+	Postinstall string `toml:"postinstall" json:"postinstall"`
+	Preinstall  string `toml:"preinstall" json:"preinstall"`
+	Postremove  string `toml:"postremove" json:"postremove"`
+	Preremove   string `toml:"preremove" json:"preremove"`
+	Postupgrade string `toml:"postupgrade" json:"postupgrade"`
+	Preupgrade  string `toml:"preupgrade" json:"preupgrade"`
 }
 
-var dbLock sync.Mutex
-
 func ParsePackageFile(path string) (*PackageRoot, error) {
 	var pkg PackageRoot
 
@@ -60,15 +60,15 @@ func ParsePackageFile(path string) (*PackageRoot, error) {
 	return &pkg, nil
 }
 
-func ExtractPackage(tarball, target string) error {
+func InspectPackage(tarball string) (*PackageRoot, error) {
 	reader, err := os.Open(tarball)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer reader.Close()
 	zstdReader, err := zstd.NewReader(reader)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	tarReader := tar.NewReader(zstdReader)
 
@@ -77,202 +77,228 @@ func ExtractPackage(tarball, target string) error {
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return err
+			return nil, err
 		}
 
-		path := filepath.Join(target, header.Name)
-		info := header.FileInfo()
+		if path.Clean(header.Name) == "package.toml" {
+			var pkg PackageRoot
 
-		if header.Typeflag == tar.TypeLink {
-			if err := os.Link(filepath.Join(target, header.Linkname), path); err != nil {
-				return err
+			if _, err := toml.DecodeReader(tarReader, &pkg); err != nil {
+				return nil, err
 			}
-			continue
-		}
 
-		if info.IsDir() {
-			if err = os.MkdirAll(path, info.Mode()); err != nil {
-				return err
-			}
-			continue
+			return &pkg, nil
 		}
+	}
 
-		if info.Mode()&os.ModeSymlink == os.ModeSymlink {
-			if err = os.Symlink(header.Linkname, path); err != nil {
-				return err
-			}
-			continue
-		}
+	return nil, &ErrorString{S: "package.toml not found"}
+}
 
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
-		if err != nil {
-			return err
-		}
-		_, err = io.Copy(file, tarReader)
-		if err != nil {
-			file.Close()
-			return err
-		}
-		file.Close()
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", &ErrorString{S: "Couldn't open file!"}
 	}
-	return nil
+	defer file.Close()
+
+	hasher := sha256.New()
+
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func InspectPackage(tarball string) (*PackageRoot, error) {
-	reader, err := os.Open(tarball)
-	if err != nil {
-		return nil, err
+// RunHook runs a package hook from inside the package's installation
+// directory, with the standard streams of the transaction's Env. Hooks are
+// serialized since they share the terminal, and aren't run at all when the
+// Env's hook policy is HooksSkip. name is the kind of hook, such as
+// postinstall, and is only used for errors.
+func (tx *Transaction) RunHook(installationPath string, name string, hook string) error {
+	if hook == "" || tx.env.Hooks == HooksSkip {
+		return nil
 	}
-	defer reader.Close()
-	zstdReader, err := zstd.NewReader(reader)
+
+	if err := os.Chmod(filepath.Join(installationPath, hook), 0755); err != nil {
+		return err
+	}
+
+	// The hook runs from inside installationPath, so a relative root would
+	// otherwise be resolved twice.
+	installationPath, err := filepath.Abs(installationPath)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	tarReader := tar.NewReader(zstdReader)
 
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
+	tx.hookLock.Lock()
+	defer tx.hookLock.Unlock()
+
+	cmd := exec.CommandContext(tx.env.context(), filepath.Join(installationPath, hook))
+
+	cmd.Stdout = tx.env.stdout()
+	cmd.Stderr = tx.env.stderr()
+	cmd.Stdin = tx.env.stdin()
+	cmd.Dir = installationPath
+
+	if err := cmd.Run(); err != nil {
+		// A hook killed because the Env was cancelled didn't fail itself.
+		if err := tx.env.cancelled(); err != nil {
+			return err
 		}
 
-		if path.Clean(header.Name) == "package.toml" {
-			var pkg PackageRoot
+		hookErr := &HookError{Package: filepath.Base(installationPath), Hook: name, ExitStatus: -1, Err: err}
 
-			if _, err := toml.DecodeReader(tarReader, &pkg); err != nil {
-				return nil, err
-			}
+		if pkg, err := ParsePackageFile(filepath.Join(installationPath, "package.toml")); err == nil {
+			hookErr.Package = pkg.Package.Name
+		}
 
-			return &pkg, nil
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			hookErr.ExitStatus = exitErr.ExitCode()
 		}
+
+		return hookErr
 	}
 
-	return nil, &ErrorString{S: "package.toml not found"}
+	return nil
 }
 
-var globalSideEffectLock sync.Mutex
+// InstallFiles links files, as listed by ScanFiles, from the package's store
+// directory in pkgPath into the root. Paths that would leave the root or the
+// store are refused. It returns the directories it created besides the ones
+// listed in files, relative to the root, for RemoveFiles to prune.
+func InstallFiles(tx *Transaction, pkgPath string, files []DBFile) ([]string, error) {
+	listed := make(map[string]bool)
+	for _, file := range files {
+		if file.Type == FileTypeDir {
+			listed[path.Clean(file.Path)] = true
+		}
+	}
 
-func InstallFiles(root string, pkgPath string, pkg *PackageRoot) error {
-	for k, v := range pkg.Files {
-		info, err := os.Stat(filepath.Join(pkgPath, v))
-		if err != nil {
-			return err
+	var dirs []string
+
+	mkdirAll := func(target string, perm os.FileMode) error {
+		created, err := tx.mkdirAll(target, perm)
+
+		for _, dir := range created {
+			if relative, relErr := filepath.Rel(tx.Root, dir); relErr == nil && !listed[filepath.ToSlash(relative)] {
+				dirs = append(dirs, filepath.ToSlash(relative))
+			}
 		}
 
-		if info.IsDir() {
-			if err := filepath.Walk(filepath.Join(pkgPath, v), func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
+		return err
+	}
 
-				relative, err := filepath.Rel(filepath.Join(pkgPath, v), path)
-				if err != nil {
-					return err
-				}
+	for _, file := range files {
+		if reason := filesPathProblem(file.Path); reason != "" {
+			return nil, &FilesError{Target: file.Path, Source: file.Source, Reason: "target is " + reason}
+		}
 
-				if info.IsDir() {
-					os.Mkdir(filepath.Join(root, k, relative), info.Mode().Perm())
-				} else {
-					info, err := os.Stat(filepath.Dir(filepath.Join(pkgPath, v, relative)))
-					if err != nil {
-						return err
-					}
-
-					if err := os.MkdirAll(filepath.Dir(filepath.Join(root, k, relative)), info.Mode().Perm()); err != nil {
-						return err
-					}
-
-					if err := os.Link(filepath.Join(pkgPath, v, relative), filepath.Join(root, k, relative)); err != nil {
-						return err
-					}
-				}
+		if reason := filesPathProblem(file.Source); reason != "" {
+			return nil, &FilesError{Target: file.Path, Source: file.Source, Reason: "source is " + reason}
+		}
 
-				return nil
-			}); err != nil {
-				return err
-			}
-		} else {
-			info, err := os.Stat(filepath.Dir(filepath.Join(pkgPath, v)))
-			if err != nil {
-				return err
-			}
+		source := filepath.Join(pkgPath, filepath.FromSlash(file.Source))
+		target := filepath.Join(tx.Root, filepath.FromSlash(file.Path))
 
-			if err := os.MkdirAll(filepath.Dir(filepath.Join(root, k)), info.Mode().Perm()); err != nil {
-				return err
+		if file.Type == FileTypeDir {
+			if err := mkdirAll(target, file.FileMode().Perm()); err != nil {
+				return nil, err
 			}
 
-			if err := os.Link(filepath.Join(pkgPath, v), filepath.Join(root, k)); err != nil {
-				return err
-			}
+			continue
+		}
+
+		info, err := os.Stat(filepath.Dir(source))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := mkdirAll(filepath.Dir(target), info.Mode().Perm()); err != nil {
+			return nil, err
+		}
+
+		if err := tx.Link(source, target); err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
+	return dirs, nil
 }
 
-func RemoveFiles(root string, pkgPath string, pkg *PackageRoot) error {
-	for k, v := range pkg.Files {
-		info, err := os.Stat(filepath.Join(pkgPath, v))
-		if err != nil {
-			return err
+// RemoveFiles unlinks the given files of a package from the root and removes
+// the directories it owns, the ones in files and the ones installing it
+// created, once they are empty. Files that are already gone are skipped.
+func RemoveFiles(tx *Transaction, pkgPath string, files []DBFile, created []string) error {
+	dirs := append([]string(nil), created...)
+
+	for _, file := range files {
+		if file.Type == FileTypeDir {
+			dirs = append(dirs, file.Path)
+			continue
 		}
 
-		if info.IsDir() {
-			if err := filepath.Walk(filepath.Join(pkgPath, v), func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
+		target := filepath.Join(tx.Root, filepath.FromSlash(file.Path))
 
-				relative, err := filepath.Rel(pkgPath, path)
-				if err != nil {
-					return err
-				}
+		if _, err := os.Lstat(target); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
 
-				if !info.IsDir() {
-					if err := os.Remove(filepath.Join(root, relative)); err != nil {
-						return err
-					}
-				}
+			return err
+		}
 
-				return nil
-			}); err != nil {
-				return nil
-			}
-		} else {
-			if err := os.Remove(filepath.Join(root, k)); err != nil {
-				return err
-			}
+		if err := tx.Remove(target, filepath.Join(pkgPath, filepath.FromSlash(file.Source))); err != nil {
+			return err
+		}
+	}
+
+	// A directory sorts before everything inside it, so in reverse order
+	// each directory is emptied before it is removed.
+	sort.Strings(dirs)
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := tx.RemoveDir(filepath.Join(tx.Root, filepath.FromSlash(dirs[i]))); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func Install(root string, packageFile string) error {
-	if err := os.MkdirAll(root, 0755); err != nil {
-		return err
-	}
+// InstallOptions controls the checks applied to package archives before and
+// while they are extracted.
+type InstallOptions struct {
+	Signatures SignaturePolicy
+	Extract    ExtractOptions
+}
 
-	pkg, err := InspectPackage(packageFile)
+// Install links a package archive extracted by ExtractArchive into the
+// root. Its temporary store is renamed to packages/<hash>, the hooks run and
+// the files are linked, without reading the archive file again.
+func Install(tx *Transaction, archive *Archive) error {
+	root := tx.Root
 
-	if err != nil {
-		return err
+	if archive.store == "" {
+		return &ErrorString{S: "Package file " + archive.Path + " hasn't been extracted"}
 	}
 
+	stringHash := archive.Hash
+	pkg := archive.Package
+	tempPath := archive.store
+
 	if err := func() error {
-		dbLock.Lock()
-		defer dbLock.Unlock()
+		tx.dbLock.Lock()
+		defer tx.dbLock.Unlock()
 
-		db, err := ReadDatabase(root)
+		db, err := ReadDatabase(tx.env)
 
 		if err != nil {
 			return err
 		}
 
 		if _, ok := db.Packages[pkg.Package.Name]; ok {
-			return &ErrorString{S: "Package is already installed with name " + pkg.Package.Name}
+			return &AlreadyInstalledError{Name: pkg.Package.Name}
 		}
 
 		return nil
@@ -280,64 +306,33 @@ func Install(root string, packageFile string) error {
 		return err
 	}
 
-	file, err := os.Open(packageFile)
-	if err != nil {
-		return &ErrorString{S: "Couldn't open file!"}
-	}
-	defer file.Close()
-
-	hasher := sha256.New()
-
-	if _, err := io.Copy(hasher, file); err != nil {
-		return err
-	}
-
-	stringHash := hex.EncodeToString(hasher.Sum(nil))
 	installationPath := filepath.Join(root, "packages", stringHash)
 
-	if err := os.MkdirAll(installationPath, 0755); err != nil {
-		return err
-	}
-
-	if err := ExtractPackage(packageFile, installationPath); err != nil {
-		return err
-	}
-
-	if err != nil {
+	if err := tx.RenameStore(tempPath, installationPath); err != nil {
 		return err
 	}
 
 	if err := func() error {
-		dbLock.Lock()
-		defer dbLock.Unlock()
+		tx.dbLock.Lock()
+		defer tx.dbLock.Unlock()
 
-		db, err := ReadDatabase(root)
+		db, err := ReadDatabase(tx.env)
 
 		if err != nil {
 			return err
 		}
 
-		for i := range pkg.Dependencies.Required {
-			dependency := pkg.Dependencies.Required[i]
-			splitdep := strings.Split(dependency, "@")
-
-			if _, ok := db.Packages[splitdep[0]]; !ok {
-				return &ErrorString{S: "Dependency not found: " + dependency}
-			}
+		for _, dependency := range pkg.Dependencies.Required {
+			depName, constraint := SplitDependency(dependency)
 
-			depVersion, err := semver.NewVersion(db.Packages[splitdep[0]].Package.Version)
-			if err != nil {
-				return err
+			installed, ok := db.Packages[depName]
+			if !ok {
+				return &ConstraintError{Package: depName, Constraint: constraint}
 			}
 
-			c, err := semver.NewConstraint(splitdep[1])
-			if err != nil {
+			if err := checkConstraint(depName, constraint, installed.Package.Version); err != nil {
 				return err
 			}
-
-			if !c.Check(depVersion) {
-				return &ErrorString{S: "Version constraint for package " + splitdep[0] + "not met. Required " + splitdep[1] + ", found " + db.Packages[splitdep[0]].Package.Version}
-			}
 		}
 
 		return nil
@@ -345,64 +340,43 @@ func Install(root string, packageFile string) error {
 		return err
 	}
 
-	if pkg.Hooks.Preinstall != "" {
-		if err := os.Chmod(filepath.Join(installationPath, pkg.Hooks.Preinstall), 0755); err != nil {
-			return err
-		}
-		globalSideEffectLock.Lock()
-		cmd := exec.Command(filepath.Join(installationPath, pkg.Hooks.Preinstall))
-
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Stdin = os.Stdin
-		cmd.Dir = installationPath
-
-		if err := cmd.Run(); err != nil {
-			globalSideEffectLock.Unlock()
-			return err
-		}
-
-		globalSideEffectLock.Unlock()
-	}
-
-	if err := InstallFiles(root, installationPath, pkg); err != nil {
+	if err := tx.RunHook(installationPath, "preinstall", pkg.Hooks.Preinstall); err != nil {
 		return err
 	}
 
-	dbLock.Lock()
-
-	db, err := ReadDatabase(root)
-
+	files, err := ScanFiles(installationPath, pkg)
 	if err != nil {
 		return err
 	}
 
-	db.Packages[pkg.Package.Name] = DBPackage{Hash: stringHash, Dependencies: pkg.Dependencies, Package: pkg.Package}
+	if err := replaceFiles(tx, pkg, files); err != nil {
+		return err
+	}
 
-	if err := WriteDatabase(root, db); err != nil {
-		dbLock.Unlock()
+	dirs, err := InstallFiles(tx, installationPath, files)
+	if err != nil {
 		return err
 	}
 
-	dbLock.Unlock()
+	if err := func() error {
+		tx.dbLock.Lock()
+		defer tx.dbLock.Unlock()
+
+		db, err := ReadDatabase(tx.env)
 
-	if pkg.Hooks.Postinstall != "" {
-		if err := os.Chmod(filepath.Join(installationPath, pkg.Hooks.Postinstall), 0755); err != nil {
+		if err != nil {
 			return err
 		}
-		globalSideEffectLock.Lock()
-		cmd := exec.Command(filepath.Join(installationPath, pkg.Hooks.Postinstall))
 
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Stdin = os.Stdin
-		cmd.Dir = installationPath
+		db.Packages[pkg.Package.Name] = DBPackage{Hash: stringHash, Reason: ReasonExplicit, Dependencies: pkg.Dependencies, Package: pkg.Package, Files: files, Dirs: dirs}
 
-		if err := cmd.Run(); err != nil {
-			globalSideEffectLock.Unlock()
-			return err
-		}
-		globalSideEffectLock.Unlock()
+		return tx.WriteDatabase(db)
+	}(); err != nil {
+		return err
+	}
+
+	if err := tx.RunHook(installationPath, "postinstall", pkg.Hooks.Postinstall); err != nil {
+		return err
 	}
 
 	return nil
@@ -418,347 +392,410 @@ func WorkerReady(point *dag.Vertex, state map[string]string) bool {
 	return true
 }
 
-func InstallWorker(root string, point *dag.Vertex, group *errgroup.Group, state map[string]string, stateLock *sync.Mutex, completedEvent *sync.Cond) {
+func workerBlocked(point *dag.Vertex, state map[string]string) bool {
+	for _, dep := range point.Children.Values() {
+		if state[dep.(*dag.Vertex).ID] == "failed" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func InstallWorker(tx *Transaction, point *dag.Vertex, archives map[string]*Archive, group *errgroup.Group, state map[string]string, completedEvent *sync.Cond) {
 	group.Go(func() error {
-		stateLock.Lock()
-		_, ok := state[point.ID]
-		if ok {
-			stateLock.Unlock()
+		completedEvent.L.Lock()
+		if _, ok := state[point.ID]; ok {
+			completedEvent.L.Unlock()
 			return nil
 		}
 
 		state[point.ID] = "working"
-		stateLock.Unlock()
-
-		for {
-			stateLock.Lock()
-			ready := WorkerReady(point, state)
-			stateLock.Unlock()
 
-			if ready {
-				break
+		for !WorkerReady(point, state) {
+			// A dependency failed to install and its error is already being
+			// reported, so there is nothing left for this worker to do.
+			if workerBlocked(point, state) {
+				state[point.ID] = "failed"
+				completedEvent.Broadcast()
+				completedEvent.L.Unlock()
+				return nil
 			}
 
 			completedEvent.Wait()
 		}
+		completedEvent.L.Unlock()
 
-		if err := Install(root, point.ID); err != nil {
-			return err
+		// Once the Env is cancelled no further package is started, and the
+		// error rolls back the ones that already were.
+		err := tx.env.cancelled()
+		if err == nil {
+			err = Install(tx, archives[point.ID])
 		}
 
-		stateLock.Lock()
-		state[point.ID] = "done"
-		stateLock.Unlock()
-
+		completedEvent.L.Lock()
+		if err != nil {
+			state[point.ID] = "failed"
+		} else {
+			state[point.ID] = "done"
+		}
 		completedEvent.Broadcast()
+		completedEvent.L.Unlock()
+
+		if err != nil {
+			return err
+		}
 
 		for _, child := range point.Parents.Values() {
-			InstallWorker(root, child.(*dag.Vertex), group, state, stateLock, completedEvent)
+			InstallWorker(tx, child.(*dag.Vertex), archives, group, state, completedEvent)
 		}
 
 		return nil
 	})
 }
 
-func InstallMultiple(root string, packageFiles []string) error {
-	if err := os.MkdirAll(root, 0755); err != nil {
-		return err
-	}
-
-	packages := dag.NewDAG()
-
-	if err := func() error {
-		dbLock.Lock()
-		defer dbLock.Unlock()
-		db, err := ReadDatabase(root)
-
-		if err != nil {
-			return err
-		}
+// installGraph is a batch of package archives ready to install: the packages
+// the resolver selected, the DAG of the order they have to be installed in,
+// and the archives by path.
+type installGraph struct {
+	packages   *dag.DAG
+	vertices   map[string]*dag.Vertex
+	resolution *Resolution
+	archives   map[string]*Archive
+}
 
-		for _, file := range packageFiles {
-			pkg, err := InspectPackage(file)
+// planInstallation resolves a batch of package archives against the
+// installed packages in db and builds the DAG they are installed along.
+func planInstallation(db *Database, archives []*Archive) (*installGraph, error) {
+	candidates := make([]Candidate, len(archives))
+	byPath := make(map[string]*Archive)
 
-			if err != nil {
-				return err
-			}
+	for i, archive := range archives {
+		pkg := archive.Package
+		byPath[archive.Path] = archive
 
-			packages.AddVertex(dag.NewVertex(file, pkg))
+		if _, ok := db.Packages[pkg.Package.Name]; ok {
+			return nil, &AlreadyInstalledError{Name: pkg.Package.Name}
 		}
 
-		for _, file := range packageFiles {
-			vertex, err := packages.GetVertex(file)
-
-			if err != nil {
-				return err
-			}
+		candidates[i] = CandidateFromPackage(pkg, archive.Path)
+	}
 
-			pkg := vertex.Value.(*PackageRoot)
+	requested := make([]Requirement, len(candidates))
+	for i := range candidates {
+		requested[i] = PinRequirement(&candidates[i])
+	}
 
-		REQUIRED:
-			for i := range pkg.Dependencies.Required {
-				dependency := pkg.Dependencies.Required[i]
-				splitdep := strings.Split(dependency, "@")
+	resolution, err := Resolve(db.Packages, candidates, requested)
+	if err != nil {
+		return nil, err
+	}
 
-				if _, ok := db.Packages[splitdep[0]]; ok {
-					depVersion, err := semver.NewVersion(db.Packages[splitdep[0]].Package.Version)
-					if err != nil {
-						return err
-					}
+	return newInstallGraph(resolution, byPath)
+}
 
-					c, err := semver.NewConstraint(splitdep[1])
-					if err != nil {
-						return err
-					}
+// newInstallGraph builds the DAG the packages of a resolution are installed
+// along. archives holds the archives of the packages by path; a package the
+// resolver picked from a repository has none until it is downloaded.
+func newInstallGraph(resolution *Resolution, byPath map[string]*Archive) (*installGraph, error) {
+	packages := dag.NewDAG()
+	vertices := make(map[string]*dag.Vertex)
 
-					if !c.Check(depVersion) {
-						return &ErrorString{S: "Version constraint for package " + splitdep[0] + "not met. Required " + splitdep[1] + ", found " + db.Packages[splitdep[0]].Package.Version}
-					}
+	for _, candidate := range resolution.Packages {
+		vertex := dag.NewVertex(candidateSource(candidate), candidate)
+		vertices[candidate.Name] = vertex
 
-					continue
-				}
+		if err := packages.AddVertex(vertex); err != nil {
+			return nil, err
+		}
+	}
 
-				for _, file2 := range packageFiles {
-					vertex2, err := packages.GetVertex(file2)
+	for _, candidate := range resolution.Packages {
+		for _, requirement := range dependencyRequirements(candidate) {
+			dependency, ok := vertices[requirement.Name]
+			if !ok || requirement.Name == candidate.Name {
+				continue
+			}
 
-					if err != nil {
-						return err
-					}
+			if err := packages.AddEdge(vertices[candidate.Name], dependency); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-					pkg2 := vertex2.Value.(*PackageRoot)
+	// A package that replaces files of another package in the batch is
+	// installed after it, so that it takes the files over instead of
+	// colliding with them, unless its dependencies already decide the order.
+	// What a package in a repository replaces isn't known before it is
+	// downloaded.
+	for _, candidate := range resolution.Packages {
+		archive, ok := byPath[candidate.File]
+		if !ok {
+			continue
+		}
 
-					if pkg2.Package.Name != splitdep[0] {
-						continue
-					}
+		for _, name := range archive.Package.Replaces {
+			replaced, ok := vertices[name]
+			if !ok || reachable(vertices[candidate.Name], replaced, make(map[*dag.Vertex]bool)) || reachable(replaced, vertices[candidate.Name], make(map[*dag.Vertex]bool)) {
+				continue
+			}
 
-					depVersion, err := semver.NewVersion(pkg2.Package.Version)
-					if err != nil {
-						return err
-					}
+			if err := packages.AddEdge(vertices[candidate.Name], replaced); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-					c, err := semver.NewConstraint(splitdep[1])
-					if err != nil {
-						return err
-					}
+	// Optional dependencies that are part of the batch are installed first
+	// too, unless they already have to come after the package.
+	for _, candidate := range resolution.Packages {
+		for _, dependency := range candidate.Dependencies.Optional {
+			name, _ := SplitDependency(dependency)
 
-					if !c.Check(depVersion) {
-						return &ErrorString{S: "Version constraint for package " + splitdep[0] + "not met. Required " + splitdep[1] + ", installing " + db.Packages[splitdep[0]].Package.Version}
-					}
+			optional, ok := vertices[name]
+			if !ok || reachable(vertices[candidate.Name], optional, make(map[*dag.Vertex]bool)) || reachable(optional, vertices[candidate.Name], make(map[*dag.Vertex]bool)) {
+				continue
+			}
 
-					if err := packages.AddEdge(vertex, vertex2); err != nil {
-						return err
-					}
+			if err := packages.AddEdge(vertices[candidate.Name], optional); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-					continue REQUIRED
-				}
+	graph := &installGraph{packages: packages, vertices: vertices, resolution: resolution, archives: byPath}
 
-				return &ErrorString{S: "Dependency not found: " + dependency}
-			}
+	// The workers would wait on each other forever if the edges made a
+	// cycle.
+	if _, err := graph.order(); err != nil {
+		return nil, err
+	}
 
-		OPTIONAL:
-			for i := range pkg.Dependencies.Optional {
-				dependency := pkg.Dependencies.Optional[i]
-				splitdep := strings.Split(dependency, "@")
+	return graph, nil
+}
 
-				if _, ok := db.Packages[splitdep[0]]; ok {
-					depVersion, err := semver.NewVersion(db.Packages[splitdep[0]].Package.Version)
-					if err != nil {
-						return err
-					}
+// candidateSource identifies a candidate in an install graph by its archive,
+// or by the repository path it would be downloaded from.
+func candidateSource(candidate *Candidate) string {
+	if candidate.Remote != nil {
+		return candidate.Remote.Repository.Name + ":" + candidate.Remote.Path
+	}
 
-					c, err := semver.NewConstraint(splitdep[1])
-					if err != nil {
-						return err
-					}
+	return candidate.File
+}
 
-					if !c.Check(depVersion) {
-						return &ErrorString{S: "Version constraint for package " + splitdep[0] + "not met. Required " + splitdep[1] + ", found " + db.Packages[splitdep[0]].Package.Version}
-					}
+// reachable reports whether to can be reached from from by following edges
+// from packages to their dependencies.
+func reachable(from *dag.Vertex, to *dag.Vertex, seen map[*dag.Vertex]bool) bool {
+	if from == to {
+		return true
+	}
 
-					continue
-				}
+	if seen[from] {
+		return false
+	}
 
-				for _, file2 := range packageFiles {
-					vertex2, err := packages.GetVertex(file2)
+	seen[from] = true
 
-					if err != nil {
-						return err
-					}
+	for _, child := range from.Children.Values() {
+		if reachable(child.(*dag.Vertex), to, seen) {
+			return true
+		}
+	}
 
-					pkg2 := vertex2.Value.(*PackageRoot)
+	return false
+}
 
-					if pkg2.Package.Name != splitdep[0] {
-						continue
-					}
+// selected returns the archives of the packages the resolver selected.
+func (g *installGraph) selected() []*Archive {
+	archives := make([]*Archive, 0, len(g.resolution.Packages))
+	for _, candidate := range g.resolution.Packages {
+		archives = append(archives, g.archives[candidate.File])
+	}
 
-					depVersion, err := semver.NewVersion(pkg2.Package.Version)
-					if err != nil {
-						return err
-					}
+	return archives
+}
 
-					c, err := semver.NewConstraint(splitdep[1])
-					if err != nil {
-						return err
-					}
+// order returns the packages in an order they can be installed one after the
+// other: every package comes after the packages its vertex points to. It
+// fails with a CycleError when the remaining packages all wait on each other.
+func (g *installGraph) order() ([]*Candidate, error) {
+	placed := make(map[string]bool)
+	var order []*Candidate
 
-					if !c.Check(depVersion) {
-						return &ErrorString{S: "Version constraint for package " + splitdep[0] + "not met. Required " + splitdep[1] + ", installing " + db.Packages[splitdep[0]].Package.Version}
-					}
+	for len(order) < len(g.resolution.Packages) {
+		progress := false
 
-					if err := packages.AddEdge(vertex, vertex2); err != nil {
-						return err
-					}
+		for _, candidate := range g.resolution.Packages {
+			if placed[candidate.Name] {
+				continue
+			}
 
-					continue OPTIONAL
+			ready := true
+			for _, child := range g.vertices[candidate.Name].Children.Values() {
+				if !placed[child.(*dag.Vertex).Value.(*Candidate).Name] {
+					ready = false
+					break
 				}
+			}
 
-				return &ErrorString{S: "Dependency not found: " + dependency}
+			if ready {
+				placed[candidate.Name] = true
+				order = append(order, candidate)
+				progress = true
 			}
 		}
 
-		return nil
-	}(); err != nil {
-		return nil
-	}
-
-	group := new(errgroup.Group)
-	state := make(map[string]string)
-	var stateLock sync.Mutex
-	condLock := sync.Mutex{}
-	condLock.Lock()
-	cond := sync.NewCond(&condLock)
-
-	entryPoints := packages.SinkVertices()
-
-	for _, point := range entryPoints {
-		InstallWorker(root, point, group, state, &stateLock, cond)
-	}
-
-	if err := group.Wait(); err != nil {
-		return err
+		if !progress {
+			return nil, g.cycle(placed)
+		}
 	}
 
-	return nil
+	return order, nil
 }
 
-func Remove(root string, packageName string) error {
-	if err := os.MkdirAll(root, 0755); err != nil {
-		return err
-	}
+// cycle finds a cycle among the packages that aren't placed yet, by
+// following unplaced dependencies until one comes up a second time.
+func (g *installGraph) cycle(placed map[string]bool) error {
+	var path []string
+	index := make(map[string]int)
 
-	installationPath := ""
+	for _, candidate := range g.resolution.Packages {
+		if !placed[candidate.Name] {
+			path = append(path, candidate.Name)
+			break
+		}
+	}
 
-	if err := func() error {
-		dbLock.Lock()
-		defer dbLock.Unlock()
-		db, err := ReadDatabase(root)
+	for {
+		current := path[len(path)-1]
+		index[current] = len(path) - 1
 
-		if err != nil {
-			return err
+		var next string
+		for _, child := range g.vertices[current].Children.Values() {
+			if name := child.(*dag.Vertex).Value.(*Candidate).Name; !placed[name] {
+				next = name
+				break
+			}
 		}
 
-		if _, ok := db.Packages[packageName]; !ok {
-			return &ErrorString{S: "Package doesn't exist"}
+		if i, ok := index[next]; ok {
+			return &CycleError{Packages: append(path[i:], next)}
 		}
 
-		for name, pkg := range db.Packages {
-			for i := range pkg.Dependencies.Required {
-				if strings.Split(pkg.Dependencies.Required[i], "@")[0] == packageName {
-					return &ErrorString{S: "Package " + name + " depends on " + packageName}
-				}
-			}
-		}
+		path = append(path, next)
+	}
+}
 
-		installationPath = filepath.Join(root, "packages", db.Packages[packageName].Hash)
+// InstallMultiple installs a batch of package archives in one transaction,
+// each package after the packages it depends on. Optional dependencies only
+// affect the order: missing ones are skipped with a notice and ones in the
+// wrong version are warned about. The packages named in
+// requested are recorded as installed explicitly, every other package in the
+// batch as a dependency. Each archive is read once: it is extracted, and
+// hashed while it is, before its signature, dependencies and files are
+// checked, and a failed check rolls the extraction back.
+func InstallMultiple(env *Env, packageFiles []string, requested []string, options InstallOptions) error {
+	root := env.Root
 
-		return nil
-	}(); err != nil {
+	if err := os.MkdirAll(root, 0755); err != nil {
 		return err
 	}
 
-	pkg, err := ParsePackageFile(filepath.Join(installationPath, "package.toml"))
+	return RunTransaction(env, func(tx *Transaction) error {
+		return installArchives(tx, packageFiles, requested, options)
+	})
+}
+
+// installArchives is InstallMultiple inside the transaction tx.
+func installArchives(tx *Transaction, packageFiles []string, requested []string, options InstallOptions) error {
+	env := tx.env
 
+	archives, err := ExtractArchives(tx, packageFiles, options.Extract)
 	if err != nil {
 		return err
 	}
 
-	if pkg.Hooks.Preremove != "" {
-		if err := os.Chmod(filepath.Join(installationPath, pkg.Hooks.Preremove), 0755); err != nil {
-			return err
-		}
-		globalSideEffectLock.Lock()
-		cmd := exec.Command(filepath.Join(installationPath, pkg.Hooks.Preremove))
+	if err := CheckSignatures(env, archives, options.Signatures); err != nil {
+		return err
+	}
 
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Stdin = os.Stdin
-		cmd.Dir = installationPath
+	db, err := ReadDatabase(env)
+	if err != nil {
+		return err
+	}
 
-		if err := cmd.Run(); err != nil {
-			globalSideEffectLock.Unlock()
-			return err
-		}
-		globalSideEffectLock.Unlock()
+	graph, err := planInstallation(db, archives)
+	if err != nil {
+		return err
 	}
 
-	if err := RemoveFiles(root, installationPath, pkg); err != nil {
+	if err := CheckPackageConflicts(tx.Root, db, graph.selected()); err != nil {
 		return err
 	}
 
-	if pkg.Hooks.Postremove != "" {
-		if err := os.Chmod(filepath.Join(installationPath, pkg.Hooks.Postremove), 0755); err != nil {
-			return err
-		}
-		globalSideEffectLock.Lock()
-		cmd := exec.Command(filepath.Join(installationPath, pkg.Hooks.Postremove))
+	reportOptional(env, graph.resolution.Optional)
+
+	group := new(errgroup.Group)
+	state := make(map[string]string)
+	var stateLock sync.Mutex
+	cond := sync.NewCond(&stateLock)
 
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Stdin = os.Stdin
-		cmd.Dir = installationPath
+	entryPoints := graph.packages.SinkVertices()
 
-		if err := cmd.Run(); err != nil {
-			globalSideEffectLock.Unlock()
-			return err
-		}
-		globalSideEffectLock.Unlock()
+	for _, point := range entryPoints {
+		InstallWorker(tx, point, graph.archives, group, state, cond)
 	}
 
-	if err := os.RemoveAll(installationPath); err != nil {
+	if err := group.Wait(); err != nil {
 		return err
 	}
 
-	if err := func() error {
-		dbLock.Lock()
-		defer dbLock.Unlock()
+	return markDependencies(tx, graph, requested)
+}
 
-		db, err := ReadDatabase(root)
-		if err != nil {
-			return err
+// reportOptional logs the optional dependencies that won't be satisfied:
+// missing ones as notices, ones in a version outside their constraint as
+// warnings.
+func reportOptional(env *Env, optional []OptionalDependency) {
+	for _, dependency := range optional {
+		if dependency.Version == "" {
+			env.notice("Skipping optional dependency " + dependency.String() + " of " + dependency.From + ", it isn't installed")
+		} else if !dependency.Satisfied {
+			env.warn("Optional dependency " + dependency.String() + " of " + dependency.From + " isn't satisfied by " + dependency.Name + "@" + dependency.Version)
 		}
+	}
+}
 
-		delete(db.Packages, packageName)
-
-		if err := WriteDatabase(root, db); err != nil {
-			return err
-		}
+// markDependencies records the packages of a batch that weren't requested
+// as installed as dependencies.
+func markDependencies(tx *Transaction, graph *installGraph, requested []string) error {
+	explicit := make(map[string]bool)
+	for _, name := range requested {
+		explicit[name] = true
+	}
 
-		return nil
-	}(); err != nil {
+	db, err := ReadDatabase(tx.env)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	for _, candidate := range graph.resolution.Packages {
+		if pkg, ok := db.Packages[candidate.Name]; ok && !explicit[candidate.Name] {
+			pkg.Reason = ReasonDependency
+			db.Packages[candidate.Name] = pkg
+		}
+	}
+
+	return tx.WriteDatabase(db)
 }
 
-func ListInstalled(root string) (map[string]DBPackage, error) {
-	if err := os.MkdirAll(root, 0755); err != nil {
+func ListInstalled(env *Env) (map[string]DBPackage, error) {
+	if err := os.MkdirAll(env.Root, 0755); err != nil {
 		return nil, err
 	}
 
-	dbLock.Lock()
-	defer dbLock.Unlock()
-	db, err := ReadDatabase(root)
+	db, err := ReadDatabase(env)
 
 	if err != nil {
 		return nil, err
@@ -767,22 +804,21 @@ func ListInstalled(root string) (map[string]DBPackage, error) {
 	return db.Packages, nil
 }
 
-func PackageInfo(root string, name string) (pkg *PackageRoot, err error) {
+func PackageInfo(env *Env, name string) (pkg *PackageRoot, err error) {
+	root := env.Root
+
 	if err := os.MkdirAll(root, 0755); err != nil {
 		return nil, err
 	}
 
-	dbLock.Lock()
-	defer dbLock.Unlock()
-
-	db, err := ReadDatabase(root)
+	db, err := ReadDatabase(env)
 
 	if err != nil {
 		return nil, err
 	}
 
 	if _, ok := db.Packages[name]; !ok {
-		return nil, &ErrorString{S: "Package doesn't exist"}
+		return nil, &NotFoundError{Kind: "Package", Name: name}
 	}
 
 	installationPath := filepath.Join(root, "packages", db.Packages[name].Hash)
@@ -795,3 +831,16 @@ func PackageInfo(root string, name string) (pkg *PackageRoot, err error) {
 
 	return pkg, nil
 }
+
+// OptionalStatus checks the optional dependencies of pkg against the
+// installed packages.
+func OptionalStatus(env *Env, pkg *PackageRoot) ([]OptionalDependency, error) {
+	installed, err := ListInstalled(env)
+	if err != nil {
+		return nil, err
+	}
+
+	return optionalDependencies("", pkg.Dependencies, func(name string) string {
+		return installed[name].Package.Version
+	}), nil
+}
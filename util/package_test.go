@@ -0,0 +1,451 @@
+package util
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildTestPackage builds a package archive in dir from a package.toml and
+// the files it ships, given by their paths in the source tree.
+func buildTestPackage(t testing.TB, dir string, name string, manifest string, files map[string]string) string {
+	t.Helper()
+
+	source := filepath.Join(dir, name)
+
+	for path, content := range files {
+		full := filepath.Join(source, filepath.FromSlash(path))
+
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(source, "package.toml"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(dir, name+".apkg")
+
+	if _, err := BuildPackage(source, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	return archive
+}
+
+func testEnv(t testing.TB) *Env {
+	return &Env{Root: t.TempDir(), Hooks: HooksSkip, Logger: log.New(io.Discard, "", 0)}
+}
+
+func TestInstallMultipleReplacingDependency(t *testing.T) {
+	dir := t.TempDir()
+
+	lib := buildTestPackage(t, dir, "lib", `spec = 1
+[package]
+name = "lib"
+version = "1.0.0"
+[files]
+"bin/tool" = "bin/tool"
+`, map[string]string{"bin/tool": "lib"})
+
+	tests := []struct {
+		name     string
+		manifest string
+	}{
+		{
+			name: "requires and replaces",
+			manifest: `spec = 1
+replaces = ["lib"]
+[package]
+name = "rep"
+version = "1.0.0"
+[dependencies]
+required = ["lib"]
+[files]
+"bin/tool" = "bin/tool"
+`,
+		},
+		{
+			name: "replaces only",
+			manifest: `spec = 1
+replaces = ["lib"]
+[package]
+name = "rep"
+version = "1.0.0"
+[files]
+"bin/tool" = "bin/tool"
+`,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rep := buildTestPackage(t, dir, "rep"+string(rune('a'+i)), test.manifest, map[string]string{"bin/tool": "rep"})
+			env := testEnv(t)
+
+			if err := InstallMultiple(env, []string{rep, lib}, []string{"rep"}, InstallOptions{Signatures: SignatureOff}); err != nil {
+				t.Fatal(err)
+			}
+
+			content, err := os.ReadFile(filepath.Join(env.Root, "bin", "tool"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(content) != "rep" {
+				t.Errorf("bin/tool is %q, want the replacing package's", content)
+			}
+		})
+	}
+}
+
+func TestPlanInstallationReplacingDependent(t *testing.T) {
+	dir := t.TempDir()
+
+	// lib requires rep, so rep has to be installed first even though it
+	// replaces lib.
+	lib := buildTestPackage(t, dir, "lib", `spec = 1
+[package]
+name = "lib"
+version = "1.0.0"
+[dependencies]
+required = ["rep"]
+`, nil)
+
+	rep := buildTestPackage(t, dir, "rep", `spec = 1
+replaces = ["lib"]
+[package]
+name = "rep"
+version = "1.0.0"
+`, nil)
+
+	archives, err := ReadArchives([]string{lib, rep})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	graph, err := planInstallation(&Database{Packages: map[string]DBPackage{}}, archives)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order, err := graph.order()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(order) != 2 || order[0].Name != "rep" || order[1].Name != "lib" {
+		t.Errorf("got order %v, want rep before lib", order)
+	}
+}
+
+func TestRemovePrunesCreatedDirectories(t *testing.T) {
+	dir := t.TempDir()
+	env := testEnv(t)
+
+	// etc exists before the package is installed, so it is left in place.
+	if err := os.MkdirAll(filepath.Join(env.Root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := buildTestPackage(t, dir, "v1", `spec = 1
+[package]
+name = "tool"
+version = "1.0.0"
+[files]
+"bin/tool" = "bin/tool"
+"share/tool/doc/readme" = "readme"
+"etc/tool/config" = "config"
+`, map[string]string{"bin/tool": "1", "readme": "readme", "config": "config"})
+
+	v2 := buildTestPackage(t, dir, "v2", `spec = 1
+[package]
+name = "tool"
+version = "2.0.0"
+[files]
+"bin/tool" = "bin/tool"
+`, map[string]string{"bin/tool": "2"})
+
+	if err := InstallMultiple(env, []string{v1}, []string{"tool"}, InstallOptions{Signatures: SignatureOff}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Upgrade(env, v2, InstallOptions{Signatures: SignatureOff}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		exists bool
+	}{
+		{path: "bin/tool", exists: true},
+		{path: "share", exists: false},
+		{path: "etc/tool", exists: false},
+		{path: "etc", exists: true},
+	}
+
+	for _, test := range tests {
+		_, err := os.Lstat(filepath.Join(env.Root, test.path))
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("after upgrade, %s exists is %v, want %v", test.path, exists, test.exists)
+		}
+	}
+
+	if err := Remove(env, "tool"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(env.Root, "bin")); !os.IsNotExist(err) {
+		t.Errorf("bin is left behind after remove")
+	}
+
+	if _, err := os.Lstat(filepath.Join(env.Root, "etc")); err != nil {
+		t.Errorf("etc, which the package didn't create, was removed: %v", err)
+	}
+}
+
+func TestUpgradeKeepsSharedDirectories(t *testing.T) {
+	dir := t.TempDir()
+	env := testEnv(t)
+
+	manifest := func(name string, version string, file string) string {
+		return "spec = 1\n[package]\nname = \"" + name + "\"\nversion = \"" + version + "\"\n[files]\n\"" + file + "\" = \"file\"\n"
+	}
+
+	v1 := buildTestPackage(t, dir, "v1", manifest("tool", "1.0.0", "bin/tool"), map[string]string{"file": "1"})
+	v2 := buildTestPackage(t, dir, "v2", manifest("tool", "2.0.0", "bin/tool"), map[string]string{"file": "2"})
+	other := buildTestPackage(t, dir, "other", manifest("other", "1.0.0", "bin/other"), map[string]string{"file": "other"})
+
+	// tool creates bin, other only adds a file to it, and bin is still in
+	// use by other while tool is upgraded.
+	for _, file := range []string{v1, other} {
+		if err := InstallMultiple(env, []string{file}, nil, InstallOptions{Signatures: SignatureOff}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Upgrade(env, v2, InstallOptions{Signatures: SignatureOff}); err != nil {
+		t.Fatal(err)
+	}
+
+	installed, err := ListInstalled(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dirs := installed["tool"].Dirs; len(dirs) != 1 || dirs[0] != "bin" {
+		t.Errorf("tool owns %v after the upgrade, want [bin]", dirs)
+	}
+
+	for _, name := range []string{"other", "tool"} {
+		if err := Remove(env, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(env.Root, "bin")); !os.IsNotExist(err) {
+		t.Errorf("bin is left behind after removing every package")
+	}
+}
+
+func TestUpgradeMultiple(t *testing.T) {
+	dir := t.TempDir()
+
+	manifest := func(name string, version string, required string) string {
+		manifest := "spec = 1\n[package]\nname = \"" + name + "\"\nversion = \"" + version + "\"\n"
+		if required != "" {
+			manifest += "[dependencies]\nrequired = [\"" + required + "\"]\n"
+		}
+
+		return manifest
+	}
+
+	lib1 := buildTestPackage(t, dir, "lib1", manifest("lib", "1.0.0", ""), nil)
+	app1 := buildTestPackage(t, dir, "app1", manifest("app", "1.0.0", "lib@^1.0"), nil)
+	lib2 := buildTestPackage(t, dir, "lib2", manifest("lib", "2.0.0", ""), nil)
+	app2 := buildTestPackage(t, dir, "app2", manifest("app", "2.0.0", "lib@^2.0"), nil)
+	broken := buildTestPackage(t, dir, "broken", manifest("app", "2.0.0", "missing"), nil)
+
+	tests := []struct {
+		name     string
+		upgrades []string
+		want     map[string]string
+		wantErr  string
+	}{
+		{
+			// app 2 needs lib 2 and lib 2 breaks app 1, so neither can be
+			// upgraded alone; lib is upgraded first although it is listed
+			// last.
+			name:     "upgrades dependencies first",
+			upgrades: []string{app2, lib2},
+			want:     map[string]string{"lib": "2.0.0", "app": "2.0.0"},
+		},
+		{
+			name:     "rolls back the whole batch",
+			upgrades: []string{broken, lib2},
+			want:     map[string]string{"lib": "1.0.0", "app": "1.0.0"},
+			wantErr:  "Dependency not found: missing",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := testEnv(t)
+
+			if err := InstallMultiple(env, []string{lib1, app1}, []string{"app"}, InstallOptions{Signatures: SignatureOff}); err != nil {
+				t.Fatal(err)
+			}
+
+			err := UpgradeMultiple(env, nil, test.upgrades, InstallOptions{Signatures: SignatureOff})
+
+			if test.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			installed, err := ListInstalled(env)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, version := range test.want {
+				if got := installed[name].Package.Version; got != version {
+					t.Errorf("%s is at %s, want %s", name, got, version)
+				}
+			}
+		})
+	}
+}
+
+func TestInstallMultipleOptionalDependencies(t *testing.T) {
+	dir := t.TempDir()
+
+	app := buildTestPackage(t, dir, "app", `spec = 1
+[package]
+name = "app"
+version = "1.0.0"
+[dependencies]
+optional = ["plugin", "extra@^2.0", "absent"]
+`, nil)
+
+	plugin := buildTestPackage(t, dir, "plugin", `spec = 1
+[package]
+name = "plugin"
+version = "1.0.0"
+`, nil)
+
+	extra := buildTestPackage(t, dir, "extra", `spec = 1
+[package]
+name = "extra"
+version = "1.0.0"
+`, nil)
+
+	var logged strings.Builder
+	env := testEnv(t)
+	env.Logger = log.New(&logged, "", 0)
+
+	options := InstallOptions{Signatures: SignatureOff}
+
+	if err := InstallMultiple(env, []string{extra}, []string{"extra"}, options); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := PlanInstall(env, []string{app, plugin}, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	for _, planned := range plan.Install {
+		order = append(order, planned.Name)
+	}
+
+	if want := []string{"plugin", "app"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("got install order %v, want %v", order, want)
+	}
+
+	if err := InstallMultiple(env, []string{app, plugin}, []string{"app"}, options); err != nil {
+		t.Fatal(err)
+	}
+
+	installed, err := ListInstalled(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := installed["app"]; !ok {
+		t.Error("app wasn't installed")
+	}
+
+	if _, ok := installed["absent"]; ok {
+		t.Error("the missing optional dependency was installed")
+	}
+
+	for _, want := range []string{
+		"Note: Skipping optional dependency absent of app@1.0.0, it isn't installed",
+		"Warning: Optional dependency extra@^2.0 of app@1.0.0 isn't satisfied by extra@1.0.0",
+	} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("got log %q, want %q", logged.String(), want)
+		}
+	}
+
+	if strings.Contains(logged.String(), "dependency plugin") {
+		t.Errorf("got log %q, want nothing about plugin", logged.String())
+	}
+
+	pkg, err := PackageInfo(env, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := OptionalStatus(env, pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []OptionalDependency{
+		{Name: "plugin", Version: "1.0.0", Satisfied: true},
+		{Name: "extra", Constraint: "^2.0", Version: "1.0.0"},
+		{Name: "absent"},
+	}
+
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("got %+v, want %+v", status, want)
+	}
+}
+
+func TestInstallGraphOrdersOptionalDependenciesFirst(t *testing.T) {
+	app := &Candidate{Name: "app", Version: "1.0.0", Dependencies: Dependencies{Optional: []string{"plugin"}}, File: "app.apkg"}
+	plugin := &Candidate{Name: "plugin", Version: "1.0.0", File: "plugin.apkg"}
+
+	graph, err := newInstallGraph(&Resolution{Packages: []*Candidate{app, plugin}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order, err := graph.order()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(order) != 2 || order[0] != plugin || order[1] != app {
+		t.Errorf("got %v, want plugin before app", order)
+	}
+}
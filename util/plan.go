@@ -0,0 +1,234 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Plan is what an install or remove would do, worked out without changing
+// the root. Packages are listed in the order they would be processed.
+type Plan struct {
+	Install []PlannedPackage `toml:"install" json:"install"`
+	Remove  []PlannedPackage `toml:"remove" json:"remove"`
+	Blocked []BlockedPackage `toml:"blocked" json:"blocked"`
+}
+
+// PlannedPackage is one package in a plan, with the files that would be
+// linked into or unlinked from the root and the hooks that would run, in
+// the order they would run in. A package that would be downloaded names the
+// repository it comes from instead of a file.
+type PlannedPackage struct {
+	Name       string        `toml:"name" json:"name"`
+	Version    string        `toml:"version" json:"version"`
+	File       string        `toml:"file,omitempty" json:"file,omitempty"`
+	Repository string        `toml:"repository,omitempty" json:"repository,omitempty"`
+	Files      []DBFile      `toml:"files" json:"files"`
+	Hooks      []PlannedHook `toml:"hooks" json:"hooks"`
+}
+
+type PlannedHook struct {
+	Name string `toml:"name" json:"name"`
+	Path string `toml:"path" json:"path"`
+}
+
+// BlockedPackage is a package the operation would fail on, and why.
+type BlockedPackage struct {
+	Name   string `toml:"name" json:"name"`
+	Reason string `toml:"reason" json:"reason"`
+}
+
+func newPlan() *Plan {
+	return &Plan{Install: []PlannedPackage{}, Remove: []PlannedPackage{}, Blocked: []BlockedPackage{}}
+}
+
+func plannedHooks(hooks ...string) []PlannedHook {
+	planned := []PlannedHook{}
+
+	for i := 0; i < len(hooks); i += 2 {
+		if hooks[i+1] != "" {
+			planned = append(planned, PlannedHook{Name: hooks[i], Path: hooks[i+1]})
+		}
+	}
+
+	return planned
+}
+
+// PlanInstall works out what InstallMultiple would do with the given package
+// archives and the named packages from the repositories, without changing
+// the root or downloading anything. Dependency resolution failures are
+// returned as errors; packages that are already installed, fail the
+// signature policy or have file conflicts are listed as blocked. Packages
+// that would be downloaded are planned from their index entries, which don't
+// list files or hooks, so their files are only checked for conflicts by the
+// install itself.
+func PlanInstall(env *Env, packageFiles []string, names []string, options InstallOptions) (*Plan, error) {
+	root := env.Root
+
+	installed, err := ListInstalled(env)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := newPlan()
+	archives := make(map[string]*Archive)
+	var local []Candidate
+
+	for _, file := range packageFiles {
+		archive, err := ReadArchive(file)
+		if err != nil {
+			return nil, err
+		}
+
+		pkg := archive.Package
+
+		if _, ok := installed[pkg.Package.Name]; ok {
+			plan.Blocked = append(plan.Blocked, BlockedPackage{Name: pkg.Package.Name, Reason: "already installed"})
+			continue
+		}
+
+		if options.Signatures == SignatureRequire {
+			if _, err := verifyArchiveSignature(root, archive); err != nil {
+				plan.Blocked = append(plan.Blocked, BlockedPackage{Name: pkg.Package.Name, Reason: "signature check failed: " + err.Error()})
+				continue
+			}
+		}
+
+		archives[archive.Path] = archive
+		local = append(local, CandidateFromPackage(pkg, archive.Path))
+	}
+
+	resolution, err := ResolvePackages(env, local, names)
+	if err != nil {
+		return nil, err
+	}
+
+	graph, err := newInstallGraph(resolution, archives)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := make(map[string]*PackageRoot)
+	batchFiles := make(map[string][]DBFile)
+
+	for _, candidate := range resolution.Packages {
+		if remote := candidate.Remote; remote != nil {
+			if options.Signatures == SignatureRequire {
+				if _, err := verifyRemoteSignature(root, remote); err != nil {
+					plan.Blocked = append(plan.Blocked, BlockedPackage{Name: candidate.Name, Reason: "signature check failed: " + err.Error()})
+				}
+			}
+
+			continue
+		}
+
+		archive := archives[candidate.File]
+
+		archiveFiles, err := archive.Files()
+		if err != nil {
+			return nil, err
+		}
+
+		batch[candidate.Name] = archive.Package
+		batchFiles[candidate.Name] = archiveFiles
+	}
+
+	conflicts, err := CheckConflicts(root, &Database{Packages: installed}, batch, batchFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := graph.order()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, candidate := range order {
+		planned := PlannedPackage{
+			Name:    candidate.Name,
+			Version: candidate.Version,
+			File:    candidate.File,
+			Files:   batchFiles[candidate.Name],
+			Hooks:   []PlannedHook{},
+		}
+
+		if remote := candidate.Remote; remote != nil {
+			planned.Repository = remote.Repository.Name
+		} else {
+			pkg := archives[candidate.File].Package
+			planned.Hooks = plannedHooks("preinstall", pkg.Hooks.Preinstall, "postinstall", pkg.Hooks.Postinstall)
+		}
+
+		if planned.Files == nil {
+			planned.Files = []DBFile{}
+		}
+
+		plan.Install = append(plan.Install, planned)
+	}
+
+	for _, conflict := range conflicts {
+		plan.Blocked = append(plan.Blocked, BlockedPackage{Name: conflict.Package, Reason: "file conflict: " + conflict.String()})
+	}
+
+	return plan, nil
+}
+
+// PlanRemove works out what RemoveMultiple would do with the named packages.
+// A package that installed packages outside of names require is listed as
+// blocked.
+func PlanRemove(env *Env, names []string) (*Plan, error) {
+	root := env.Root
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	db, err := ReadDatabase(env)
+	if err != nil {
+		return nil, err
+	}
+
+	removing := make(map[string]bool)
+
+	for _, name := range names {
+		if _, ok := db.Packages[name]; !ok {
+			return nil, &NotFoundError{Kind: "Package", Name: name}
+		}
+
+		removing[name] = true
+	}
+
+	plan := newPlan()
+
+	for _, name := range removalOrder(db, names) {
+		dbPackage := db.Packages[name]
+
+		for _, dependent := range dependentsOf(db, name) {
+			if !removing[dependent] {
+				plan.Blocked = append(plan.Blocked, BlockedPackage{Name: name, Reason: "required by " + dependent})
+			}
+		}
+
+		pkg, err := ParsePackageFile(filepath.Join(root, "packages", dbPackage.Hash, "package.toml"))
+		if err != nil {
+			return nil, err
+		}
+
+		files, err := installedFiles(root, dbPackage)
+		if err != nil {
+			return nil, err
+		}
+
+		if files == nil {
+			files = []DBFile{}
+		}
+
+		plan.Remove = append(plan.Remove, PlannedPackage{
+			Name:    name,
+			Version: dbPackage.Package.Version,
+			Files:   files,
+			Hooks:   plannedHooks("preremove", pkg.Hooks.Preremove, "postremove", pkg.Hooks.Postremove),
+		})
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,137 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/goombaio/dag"
+)
+
+// testGraph builds an installGraph for the named packages with an edge from
+// every key of edges to each of its values.
+func testGraph(t *testing.T, names []string, edges map[string][]string) *installGraph {
+	graph := &installGraph{packages: dag.NewDAG(), vertices: make(map[string]*dag.Vertex), resolution: &Resolution{}}
+
+	for _, name := range names {
+		candidate := &Candidate{Name: name, Version: "1.0.0", File: name + ".apkg"}
+		graph.resolution.Packages = append(graph.resolution.Packages, candidate)
+		graph.vertices[name] = dag.NewVertex(candidate.File, candidate)
+
+		if err := graph.packages.AddVertex(graph.vertices[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for from, tos := range edges {
+		for _, to := range tos {
+			if err := graph.packages.AddEdge(graph.vertices[from], graph.vertices[to]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return graph
+}
+
+func TestInstallGraphOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		edges   map[string][]string
+		want    []string
+		wantErr []string
+	}{
+		{
+			name:  "dependencies first",
+			names: []string{"app", "lib", "core"},
+			edges: map[string][]string{"app": {"lib"}, "lib": {"core"}},
+			want:  []string{"core", "lib", "app"},
+		},
+		{
+			name:    "cycle",
+			names:   []string{"a", "b"},
+			edges:   map[string][]string{"a": {"b"}, "b": {"a"}},
+			wantErr: []string{"a", "b", "a"},
+		},
+		{
+			name:    "cycle behind a package",
+			names:   []string{"app", "x", "y", "z"},
+			edges:   map[string][]string{"app": {"x"}, "x": {"y"}, "y": {"z"}, "z": {"x"}},
+			wantErr: []string{"x", "y", "z", "x"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			order, err := testGraph(t, test.names, test.edges).order()
+
+			if test.wantErr != nil {
+				var cycle *CycleError
+				if !errors.As(err, &cycle) || !reflect.DeepEqual(cycle.Packages, test.wantErr) {
+					t.Fatalf("got error %v, want the cycle %v", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, candidate := range order {
+				got = append(got, candidate.Name)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPlanInstallDoesNotDownload(t *testing.T) {
+	directory := testRepository(t)
+
+	greeter := buildTestPackage(t, t.TempDir(), "greeter", `spec = 1
+[package]
+name = "greeter"
+version = "1.0.0"
+[dependencies]
+required = ["hello"]
+[files]
+"bin/greet" = "greet"
+`, map[string]string{"greet": "greet"})
+
+	env := testEnv(t)
+
+	if err := WriteRepositories(env.Root, &RepositoryConfig{Repositories: []Repository{{Name: "main", URL: directory}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := PlanInstall(env, []string{greeter}, nil, InstallOptions{Signatures: SignatureOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plan.Install) != 2 {
+		t.Fatalf("got %+v, want hello and greeter", plan.Install)
+	}
+
+	hello, planned := plan.Install[0], plan.Install[1]
+
+	if hello.Name != "hello" || hello.Repository != "main" || hello.File != "" {
+		t.Errorf("got %+v, want hello from main", hello)
+	}
+
+	if planned.Name != "greeter" || planned.File != greeter || len(planned.Files) != 1 || planned.Files[0].Path != "bin/greet" {
+		t.Errorf("got %+v, want greeter from %s linking bin/greet", planned, greeter)
+	}
+
+	if _, err := os.Stat(filepath.Join(env.Root, "cache")); !os.IsNotExist(err) {
+		t.Errorf("planning created the download cache (%v)", err)
+	}
+}
@@ -0,0 +1,326 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+func Remove(env *Env, packageName string) error {
+	return RemoveMultiple(env, []string{packageName})
+}
+
+// RemoveMultiple removes installed packages in one transaction. Packages are
+// removed dependents first, so that the hooks of every package run while the
+// packages it depends on are still installed. It fails when a package that
+// isn't being removed requires one that is.
+func RemoveMultiple(env *Env, names []string) error {
+	root := env.Root
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+
+	db, err := ReadDatabase(env)
+	if err != nil {
+		return err
+	}
+
+	if err := checkRemoval(db, names); err != nil {
+		return err
+	}
+
+	type removal struct {
+		name             string
+		installationPath string
+		pkg              *PackageRoot
+		files            []DBFile
+		dirs             []string
+	}
+
+	var removals []removal
+
+	for _, name := range removalOrder(db, names) {
+		installationPath := filepath.Join(root, "packages", db.Packages[name].Hash)
+
+		files, err := installedFiles(root, db.Packages[name])
+		if err != nil {
+			return err
+		}
+
+		pkg, err := ParsePackageFile(filepath.Join(installationPath, "package.toml"))
+
+		if err != nil {
+			return err
+		}
+
+		removals = append(removals, removal{name: name, installationPath: installationPath, pkg: pkg, files: files, dirs: db.Packages[name].Dirs})
+	}
+
+	return RunTransaction(env, func(tx *Transaction) error {
+		for _, removal := range removals {
+			if err := env.cancelled(); err != nil {
+				return err
+			}
+
+			if err := tx.RunHook(removal.installationPath, "preremove", removal.pkg.Hooks.Preremove); err != nil {
+				return err
+			}
+
+			if err := RemoveFiles(tx, removal.installationPath, removal.files, removal.dirs); err != nil {
+				return err
+			}
+
+			if err := tx.RunHook(removal.installationPath, "postremove", removal.pkg.Hooks.Postremove); err != nil {
+				return err
+			}
+
+			if err := tx.DropStore(removal.installationPath); err != nil {
+				return err
+			}
+
+			db, err := ReadDatabase(env)
+			if err != nil {
+				return err
+			}
+
+			delete(db.Packages, removal.name)
+
+			if err := tx.WriteDatabase(db); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// checkRemoval fails when one of names isn't installed, or when a package
+// outside of names requires one of them.
+func checkRemoval(db *Database, names []string) error {
+	removing := make(map[string]bool)
+
+	for _, name := range names {
+		if _, ok := db.Packages[name]; !ok {
+			return &NotFoundError{Kind: "Package", Name: name}
+		}
+
+		removing[name] = true
+	}
+
+	for _, name := range names {
+		var blocking []string
+
+		for _, dependent := range dependentsOf(db, name) {
+			if !removing[dependent] {
+				blocking = append(blocking, dependent)
+			}
+		}
+
+		if len(blocking) != 0 {
+			return &DependentsError{Package: name, Dependents: blocking}
+		}
+	}
+
+	return nil
+}
+
+// RemovalOrder returns the named packages, together with every installed
+// package that requires one of them, directly or through other packages,
+// when recursive is set, in the order RemoveMultiple removes them in.
+func RemovalOrder(env *Env, names []string, recursive bool) ([]string, error) {
+	db, err := ReadDatabase(env)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		if _, ok := db.Packages[name]; !ok {
+			return nil, &NotFoundError{Kind: "Package", Name: name}
+		}
+	}
+
+	if recursive {
+		names = append(names, transitiveDependents(db, names)...)
+	}
+
+	unique := make(map[string]bool)
+	var all []string
+
+	for _, name := range names {
+		if !unique[name] {
+			unique[name] = true
+			all = append(all, name)
+		}
+	}
+
+	return removalOrder(db, all), nil
+}
+
+// transitiveDependents returns the sorted names of the installed packages
+// outside of names that require one of them, directly or through other
+// packages.
+func transitiveDependents(db *Database, names []string) []string {
+	seen := make(map[string]bool)
+	queue := append([]string{}, names...)
+
+	for _, name := range names {
+		seen[name] = true
+	}
+
+	var dependents []string
+
+	for len(queue) != 0 {
+		name := queue[0]
+		queue = queue[1:]
+
+		for _, dependent := range dependentsOf(db, name) {
+			if !seen[dependent] {
+				seen[dependent] = true
+				dependents = append(dependents, dependent)
+				queue = append(queue, dependent)
+			}
+		}
+	}
+
+	sort.Strings(dependents)
+
+	return dependents
+}
+
+// removalOrder sorts names so that every package comes before the packages
+// it requires or optionally depends on, the reverse of the order
+// InstallMultiple installs them in. Ties, and dependency cycles, are broken
+// by name.
+func removalOrder(db *Database, names []string) []string {
+	remaining := append([]string{}, names...)
+	sort.Strings(remaining)
+
+	order := make([]string, 0, len(remaining))
+
+	for len(remaining) != 0 {
+		next := 0
+
+		for i, name := range remaining {
+			if !dependedOn(db, name, remaining) {
+				next = i
+				break
+			}
+		}
+
+		order = append(order, remaining[next])
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+
+	return order
+}
+
+// dependedOn reports whether another package among names requires or
+// optionally depends on name.
+func dependedOn(db *Database, name string, names []string) bool {
+	for _, other := range names {
+		if other == name {
+			continue
+		}
+
+		dependencies := db.Packages[other].Dependencies
+
+		for _, dependency := range append(append([]string{}, dependencies.Required...), dependencies.Optional...) {
+			if depName, _ := SplitDependency(dependency); depName == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// dependentsOf returns the sorted names of the installed packages that
+// require name.
+func dependentsOf(db *Database, name string) []string {
+	var dependents []string
+
+	for dependentName, pkg := range db.Packages {
+		for _, dependency := range pkg.Dependencies.Required {
+			if depName, _ := SplitDependency(dependency); depName == name {
+				dependents = append(dependents, dependentName)
+				break
+			}
+		}
+	}
+
+	sort.Strings(dependents)
+
+	return dependents
+}
+
+// FindOrphans returns the sorted names of the packages that were installed
+// as dependencies and that no explicitly installed package requires any
+// more, directly or through other packages.
+func FindOrphans(env *Env) ([]string, error) {
+	db, err := ReadDatabase(env)
+	if err != nil {
+		return nil, err
+	}
+
+	reachable := make(map[string]bool)
+	var queue []string
+
+	for name, pkg := range db.Packages {
+		if pkg.Reason != ReasonDependency {
+			reachable[name] = true
+			queue = append(queue, name)
+		}
+	}
+
+	for len(queue) != 0 {
+		name := queue[0]
+		queue = queue[1:]
+
+		for _, dependency := range db.Packages[name].Dependencies.Required {
+			depName, _ := SplitDependency(dependency)
+
+			if _, ok := db.Packages[depName]; ok && !reachable[depName] {
+				reachable[depName] = true
+				queue = append(queue, depName)
+			}
+		}
+	}
+
+	orphans := []string{}
+
+	for name := range db.Packages {
+		if !reachable[name] {
+			orphans = append(orphans, name)
+		}
+	}
+
+	sort.Strings(orphans)
+
+	return orphans, nil
+}
+
+// MarkPackages records why the named packages are installed. reason is
+// ReasonExplicit or ReasonDependency.
+func MarkPackages(env *Env, names []string, reason string) error {
+	if reason != ReasonExplicit && reason != ReasonDependency {
+		return &ErrorString{S: "Unknown install reason " + reason + ", expected explicit or dependency"}
+	}
+
+	db, err := ReadDatabase(env)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		pkg, ok := db.Packages[name]
+		if !ok {
+			return &NotFoundError{Kind: "Package", Name: name}
+		}
+
+		pkg.Reason = reason
+		db.Packages[name] = pkg
+	}
+
+	return WriteDatabase(env, db)
+}
@@ -0,0 +1,237 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckRemoval(t *testing.T) {
+	db := &Database{Packages: map[string]DBPackage{
+		"lib":   installedPackage("lib", "1.0.0"),
+		"app":   installedPackage("app", "1.0.0", "lib"),
+		"tool":  installedPackage("tool", "1.0.0", "lib"),
+		"other": installedPackage("other", "1.0.0"),
+	}}
+
+	tests := []struct {
+		name           string
+		names          []string
+		wantDependents []string
+		wantNotFound   bool
+	}{
+		{name: "nothing depends on it", names: []string{"other"}},
+		{name: "dependents removed too", names: []string{"lib", "app", "tool"}},
+		{name: "one dependent left", names: []string{"lib", "app"}, wantDependents: []string{"tool"}},
+		{name: "dependents left", names: []string{"lib"}, wantDependents: []string{"app", "tool"}},
+		{name: "not installed", names: []string{"missing"}, wantNotFound: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkRemoval(db, test.names)
+
+			var notFound *NotFoundError
+			if test.wantNotFound {
+				if !errors.As(err, &notFound) {
+					t.Fatalf("got error %v, want a NotFoundError", err)
+				}
+
+				return
+			}
+
+			if test.wantDependents == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			var dependents *DependentsError
+			if !errors.As(err, &dependents) {
+				t.Fatalf("got error %v, want a DependentsError", err)
+			}
+
+			if dependents.Package != "lib" || !reflect.DeepEqual(dependents.Dependents, test.wantDependents) {
+				t.Errorf("got %s blocked by %v, want lib blocked by %v", dependents.Package, dependents.Dependents, test.wantDependents)
+			}
+		})
+	}
+}
+
+// testDatabase writes a database with the given packages to the root of env.
+// Packages named in dependencies are recorded as installed as dependencies,
+// the others as installed explicitly.
+func testDatabase(t *testing.T, env *Env, packages []DBPackage, dependencies ...string) {
+	t.Helper()
+
+	db := &Database{Packages: make(map[string]DBPackage)}
+
+	for _, pkg := range packages {
+		pkg.Reason = ReasonExplicit
+		db.Packages[pkg.Package.Name] = pkg
+	}
+
+	for _, name := range dependencies {
+		pkg := db.Packages[name]
+		pkg.Reason = ReasonDependency
+		db.Packages[name] = pkg
+	}
+
+	if err := WriteDatabase(env, db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	packages := []DBPackage{
+		installedPackage("app", "1.0.0", "lib"),
+		installedPackage("lib", "1.0.0", "core@^1.0"),
+		installedPackage("core", "1.0.0"),
+		installedPackage("old", "1.0.0", "core"),
+		installedPackage("leftover", "1.0.0"),
+	}
+
+	tests := []struct {
+		name         string
+		dependencies []string
+		want         []string
+	}{
+		{name: "everything explicit", want: []string{}},
+		{name: "required through a chain", dependencies: []string{"lib", "core"}, want: []string{}},
+		{name: "unrequired dependency", dependencies: []string{"lib", "core", "leftover"}, want: []string{"leftover"}},
+		{name: "only required by orphans", dependencies: []string{"app", "lib"}, want: []string{"app", "lib"}},
+		{name: "also required by an explicit package", dependencies: []string{"app", "lib", "core"}, want: []string{"app", "lib"}},
+		{name: "required by an orphan only", dependencies: []string{"app", "lib", "core", "old"}, want: []string{"app", "core", "lib", "old"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := testEnv(t)
+			testDatabase(t, env, packages, test.dependencies...)
+
+			orphans, err := FindOrphans(env)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(orphans, test.want) {
+				t.Errorf("got orphans %v, want %v", orphans, test.want)
+			}
+		})
+	}
+}
+
+func TestMarkPackages(t *testing.T) {
+	env := testEnv(t)
+	testDatabase(t, env, []DBPackage{installedPackage("app", "1.0.0", "lib"), installedPackage("lib", "1.0.0")}, "lib")
+
+	if err := MarkPackages(env, []string{"lib"}, ReasonExplicit); err != nil {
+		t.Fatal(err)
+	}
+
+	if orphans, err := FindOrphans(env); err != nil || len(orphans) != 0 {
+		t.Errorf("got orphans %v (%v) after marking lib explicit, want none", orphans, err)
+	}
+
+	if err := MarkPackages(env, []string{"app", "lib"}, ReasonDependency); err != nil {
+		t.Fatal(err)
+	}
+
+	if orphans, err := FindOrphans(env); err != nil || !reflect.DeepEqual(orphans, []string{"app", "lib"}) {
+		t.Errorf("got orphans %v (%v) after marking both as dependencies, want app and lib", orphans, err)
+	}
+
+	if _, ok := MarkPackages(env, []string{"missing"}, ReasonExplicit).(*NotFoundError); !ok {
+		t.Error("marking a package that isn't installed didn't fail with a NotFoundError")
+	}
+
+	if err := MarkPackages(env, []string{"app"}, "manual"); err == nil {
+		t.Error("marked a package with an unknown reason")
+	}
+}
+
+func TestInstallAndAutoremove(t *testing.T) {
+	dir := t.TempDir()
+
+	app := buildTestPackage(t, dir, "app", `spec = 1
+[package]
+name = "app"
+version = "1.0.0"
+[dependencies]
+required = ["lib"]
+`, nil)
+
+	lib := buildTestPackage(t, dir, "lib", `spec = 1
+[package]
+name = "lib"
+version = "1.0.0"
+[files]
+"lib/liblib.so" = "liblib.so"
+`, map[string]string{"liblib.so": "lib"})
+
+	env := testEnv(t)
+
+	if err := InstallMultiple(env, []string{app, lib}, []string{"app"}, InstallOptions{Signatures: SignatureOff}); err != nil {
+		t.Fatal(err)
+	}
+
+	installed, err := ListInstalled(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if installed["app"].Reason != ReasonExplicit || installed["lib"].Reason != ReasonDependency {
+		t.Fatalf("got reasons app %s and lib %s, want explicit and dependency", installed["app"].Reason, installed["lib"].Reason)
+	}
+
+	if orphans, err := FindOrphans(env); err != nil || len(orphans) != 0 {
+		t.Fatalf("got orphans %v (%v) while app is installed, want none", orphans, err)
+	}
+
+	if err := RemoveMultiple(env, []string{"app"}); err != nil {
+		t.Fatal(err)
+	}
+
+	orphans, err := FindOrphans(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(orphans, []string{"lib"}) {
+		t.Fatalf("got orphans %v after removing app, want lib", orphans)
+	}
+
+	if err := RemoveMultiple(env, orphans); err != nil {
+		t.Fatal(err)
+	}
+
+	if installed, err := ListInstalled(env); err != nil || len(installed) != 0 {
+		t.Errorf("got installed %v (%v) after autoremove, want nothing", installed, err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(env.Root, "lib", "liblib.so")); !os.IsNotExist(err) {
+		t.Error("lib/liblib.so is still installed")
+	}
+}
+
+func TestReadDatabaseDefaultsReasonToExplicit(t *testing.T) {
+	env := testEnv(t)
+
+	legacy := "[package.old]\nhash = \"x\"\n[package.old.package]\nname = \"old\"\nversion = \"1.0.0\"\n"
+	if err := os.WriteFile(databasePath(env.Root, 0), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := ReadDatabase(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reason := db.Packages["old"].Reason; reason != ReasonExplicit {
+		t.Errorf("got reason %q for a package installed before reasons were recorded, want explicit", reason)
+	}
+}
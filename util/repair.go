@@ -0,0 +1,155 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Repair relinks the files of the named installed packages, or of every
+// installed package when names is empty, from their store directories.
+// Missing paths are linked again, paths that were replaced or modified are
+// moved out of the way and relinked, and wrong modes are reset. The database
+// is left untouched; the postinstall hook only runs when runHooks is set.
+// Files whose store copy was itself modified can't be restored this way and
+// fail the repair. The returned results list every path that was repaired.
+func Repair(env *Env, names []string, runHooks bool) ([]VerifyResult, error) {
+	root := env.Root
+
+	installed, err := ListInstalled(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		for name := range installed {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	repaired := []VerifyResult{}
+
+	if err := RunTransaction(env, func(tx *Transaction) error {
+		for _, name := range names {
+			if err := env.cancelled(); err != nil {
+				return err
+			}
+
+			dbPackage, ok := installed[name]
+			if !ok {
+				return &NotFoundError{Kind: "Package", Name: name}
+			}
+
+			installationPath := filepath.Join(root, "packages", dbPackage.Hash)
+
+			pkg, err := ParsePackageFile(filepath.Join(installationPath, "package.toml"))
+			if err != nil {
+				return &ErrorString{S: "Couldn't read the store for " + name + ", reinstall it instead: " + err.Error()}
+			}
+
+			files, err := installedFiles(root, dbPackage)
+			if err != nil {
+				return err
+			}
+
+			changed := false
+
+			for _, file := range files {
+				status, detail, err := verifyFile(root, installationPath, file)
+				if err != nil {
+					return err
+				}
+
+				if status == "" {
+					continue
+				}
+
+				if err := repairFile(tx, installationPath, file); err != nil {
+					return &ErrorString{S: "Couldn't repair " + file.Path + " (" + name + "): " + err.Error()}
+				}
+
+				changed = true
+				repaired = append(repaired, VerifyResult{Package: name, Path: file.Path, Status: status, Detail: detail})
+			}
+
+			if changed && runHooks {
+				if err := tx.RunHook(installationPath, "postinstall", pkg.Hooks.Postinstall); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return repaired, nil
+}
+
+func repairFile(tx *Transaction, installationPath string, file DBFile) error {
+	target := filepath.Join(tx.Root, filepath.FromSlash(file.Path))
+	source := filepath.Join(installationPath, filepath.FromSlash(file.Source))
+
+	sourceInfo, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if file.Type == FileTypeDir {
+		if err == nil && !info.IsDir() {
+			if err := tx.MoveAside(target); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.MkdirAll(target, file.FileMode().Perm()); err != nil {
+			return err
+		}
+
+		return tx.Chmod(target, file.FileMode().Perm())
+	}
+
+	if err == nil && os.SameFile(info, sourceInfo) {
+		if file.Type == FileTypeFile && file.Hash != "" {
+			hash, err := HashFile(source)
+			if err != nil {
+				return err
+			}
+
+			if hash != file.Hash {
+				return &ErrorString{S: "the store copy was modified, reinstall the package"}
+			}
+		}
+
+		if file.Type == FileTypeSymlink {
+			return nil
+		}
+
+		return tx.Chmod(target, file.FileMode().Perm())
+	}
+
+	if err == nil {
+		if err := tx.MoveAside(target); err != nil {
+			return err
+		}
+	}
+
+	parent, err := os.Stat(filepath.Dir(source))
+	if err != nil {
+		return err
+	}
+
+	if err := tx.MkdirAll(filepath.Dir(target), parent.Mode().Perm()); err != nil {
+		return err
+	}
+
+	return tx.Link(source, target)
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	for _, test := range verifyDamage {
+		t.Run(test.name, func(t *testing.T) {
+			env := installVerifyPackage(t)
+			test.damage(t, env.Root)
+
+			before, err := os.ReadFile(databasePath(env.Root, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			repaired, err := Repair(env, nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(repaired, test.want) {
+				t.Errorf("repaired %+v, want %+v", repaired, test.want)
+			}
+
+			if results, err := Verify(env, nil); err != nil || len(results) != 0 {
+				t.Errorf("got %+v (%v) after the repair, want a clean root", results, err)
+			}
+
+			if after, err := os.ReadFile(databasePath(env.Root, 0)); err != nil || !bytes.Equal(after, before) {
+				t.Errorf("the repair changed the database (%v)", err)
+			}
+		})
+	}
+}
+
+func TestRepairStoreModifiedInPlace(t *testing.T) {
+	env := installVerifyPackage(t)
+	tool := filepath.Join(env.Root, "bin", "tool")
+
+	mustDo(t, os.WriteFile(tool, []byte("changed"), 0644))
+	mustDo(t, os.Remove(filepath.Join(env.Root, "share", "tool", "data")))
+
+	if _, err := Repair(env, []string{"tool"}, false); err == nil {
+		t.Fatal("repaired a file whose store copy was modified")
+	}
+
+	// The failed repair is rolled back as a whole.
+	if _, err := os.Lstat(filepath.Join(env.Root, "share", "tool", "data")); !os.IsNotExist(err) {
+		t.Error("share/tool/data was relinked by a repair that failed")
+	}
+
+	if content, err := os.ReadFile(tool); err != nil || string(content) != "changed" {
+		t.Errorf("got bin/tool %q (%v), want it left alone", content, err)
+	}
+}
+
+func TestRepairUnknownPackage(t *testing.T) {
+	env := installVerifyPackage(t)
+
+	_, err := Repair(env, []string{"missing"}, false)
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Errorf("got error %v, want a NotFoundError", err)
+	}
+}
@@ -0,0 +1,356 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+type RepositoryConfig struct {
+	Repositories []Repository `toml:"repository"`
+}
+
+type Repository struct {
+	Name string `toml:"name"`
+	URL  string `toml:"url"`
+}
+
+type RepositoryIndex struct {
+	Packages []IndexPackage `toml:"package" json:"packages"`
+}
+
+type IndexPackage struct {
+	Name         string       `toml:"name" json:"name"`
+	Version      string       `toml:"version" json:"version"`
+	Description  string       `toml:"description" json:"description"`
+	Hash         string       `toml:"hash" json:"hash"`
+	Path         string       `toml:"path" json:"path"`
+	Size         int64        `toml:"size" json:"size"`
+	Modified     time.Time    `toml:"modified" json:"modified"`
+	Dependencies Dependencies `toml:"dependencies" json:"dependencies"`
+	Signature    *Signature   `toml:"signature,omitempty" json:"signature,omitempty"`
+}
+
+// RemotePackage is an index entry together with the repository it was
+// published in.
+type RemotePackage struct {
+	Repository Repository
+	IndexPackage
+}
+
+func ReadRepositories(root string) (*RepositoryConfig, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	var config RepositoryConfig
+
+	if _, err := toml.DecodeFile(filepath.Join(root, "repositories.toml"), &config); err != nil {
+		if os.IsNotExist(err) {
+			return &config, nil
+		}
+
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+func WriteRepositories(root string, config *RepositoryConfig) error {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(root, "repositories.toml"), func(file *os.File) error {
+		return toml.NewEncoder(file).Encode(config)
+	})
+}
+
+func AddRepository(root string, name string, repositoryURL string) error {
+	config, err := ReadRepositories(root)
+	if err != nil {
+		return err
+	}
+
+	for _, repository := range config.Repositories {
+		if repository.Name == name {
+			return &ErrorString{S: "Repository already exists with name " + name}
+		}
+	}
+
+	if _, err := url.Parse(repositoryURL); err != nil {
+		return err
+	}
+
+	config.Repositories = append(config.Repositories, Repository{Name: name, URL: repositoryURL})
+
+	return WriteRepositories(root, config)
+}
+
+func RemoveRepository(root string, name string) error {
+	config, err := ReadRepositories(root)
+	if err != nil {
+		return err
+	}
+
+	for i, repository := range config.Repositories {
+		if repository.Name == name {
+			config.Repositories = append(config.Repositories[:i], config.Repositories[i+1:]...)
+			return WriteRepositories(root, config)
+		}
+	}
+
+	return &NotFoundError{Kind: "Repository", Name: name}
+}
+
+// openRepositoryFile opens a file relative to the repository URL. HTTP(S)
+// repositories are fetched over the network, file:// URLs and bare paths
+// are read from the local filesystem. Requests are cancelled with ctx.
+func openRepositoryFile(ctx context.Context, repository Repository, name string) (io.ReadCloser, error) {
+	parsed, err := url.Parse(repository.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch parsed.Scheme {
+	case "http", "https":
+		target := strings.TrimSuffix(repository.URL, "/") + "/" + (&url.URL{Path: name}).EscapedPath()
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			return nil, &ErrorString{S: "Failed to fetch " + target + ": " + response.Status}
+		}
+
+		return response.Body, nil
+	case "file", "":
+		directory := parsed.Path
+		if parsed.Scheme == "" {
+			directory = repository.URL
+		}
+
+		return os.Open(filepath.Join(directory, filepath.FromSlash(name)))
+	default:
+		return nil, &ErrorString{S: "Unsupported repository URL scheme " + parsed.Scheme}
+	}
+}
+
+func FetchIndex(ctx context.Context, repository Repository) (*RepositoryIndex, error) {
+	reader, err := openRepositoryFile(ctx, repository, "index.toml")
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var index RepositoryIndex
+
+	if _, err := toml.DecodeReader(reader, &index); err != nil {
+		return nil, err
+	}
+
+	return &index, nil
+}
+
+func FetchRemotePackages(env *Env) ([]RemotePackage, error) {
+	config, err := ReadRepositories(env.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	var packages []RemotePackage
+
+	for _, repository := range config.Repositories {
+		index, err := FetchIndex(env.context(), repository)
+		if err != nil {
+			return nil, &ErrorString{S: "Couldn't fetch index for repository " + repository.Name + ": " + err.Error()}
+		}
+
+		for _, pkg := range index.Packages {
+			packages = append(packages, RemotePackage{Repository: repository, IndexPackage: pkg})
+		}
+	}
+
+	return packages, nil
+}
+
+// DownloadPackage fetches a package into the download cache under the root
+// and checks it against the hash published in the index. Cached archives
+// whose hash still matches are reused.
+func DownloadPackage(env *Env, pkg RemotePackage) (string, error) {
+	cachePath := filepath.Join(env.Root, "cache")
+	if err := os.MkdirAll(cachePath, 0755); err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(cachePath, pkg.Hash+".apkg")
+
+	if hash, err := HashFile(target); err == nil && hash == pkg.Hash {
+		return target, writeCachedSignature(target, pkg.Signature)
+	}
+
+	reader, err := openRepositoryFile(env.context(), pkg.Repository, pkg.Path)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	file, err := os.CreateTemp(cachePath, "download-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+
+	hasher := sha256.New()
+
+	if _, err := io.Copy(io.MultiWriter(file, hasher), reader); err != nil {
+		file.Close()
+		return "", err
+	}
+
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+
+	if hash := hex.EncodeToString(hasher.Sum(nil)); hash != pkg.Hash {
+		return "", &ErrorString{S: "Hash mismatch for " + pkg.Name + "@" + pkg.Version + ": expected " + pkg.Hash + ", got " + hash}
+	}
+
+	if err := os.Rename(file.Name(), target); err != nil {
+		return "", err
+	}
+
+	return target, writeCachedSignature(target, pkg.Signature)
+}
+
+// writeCachedSignature stores the signature published in the index next to
+// a downloaded archive, so that it is checked like a local signed archive.
+func writeCachedSignature(target string, signature *Signature) error {
+	if signature == nil {
+		if err := os.Remove(target + SignatureSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	return WriteSignature(target, signature)
+}
+
+// ResolvePackages resolves the named packages, together with everything the
+// local packages and the named packages depend on, against the installed
+// packages, the local packages and the configured repositories. local are
+// the package files given directly, as made by CandidateFromPackage. Without
+// names, the repository indexes are only fetched when the local packages
+// need a dependency that neither they nor the installed packages provide.
+func ResolvePackages(env *Env, local []Candidate, names []string) (*Resolution, error) {
+	installed, err := ListInstalled(env)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, target := range names {
+		name, _ := SplitDependency(target)
+
+		if _, ok := installed[name]; ok {
+			return nil, &AlreadyInstalledError{Name: name}
+		}
+	}
+
+	candidates := append([]Candidate(nil), local...)
+
+	// Pinned requirements point into candidates, so they are made again
+	// whenever candidates grows.
+	requirements := func() []Requirement {
+		requested := make([]Requirement, 0, len(local)+len(names))
+
+		for i := range local {
+			requested = append(requested, PinRequirement(&candidates[i]))
+		}
+
+		for _, target := range names {
+			name, constraint := SplitDependency(target)
+			requested = append(requested, Requirement{Name: name, Constraint: constraint})
+		}
+
+		return requested
+	}
+
+	if len(names) == 0 {
+		var constraint *ConstraintError
+
+		resolution, err := Resolve(installed, candidates, requirements())
+		if err == nil {
+			return resolution, nil
+		} else if !errors.As(err, &constraint) {
+			return nil, err
+		}
+	}
+
+	remote, err := FetchRemotePackages(env)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range remote {
+		candidates = append(candidates, CandidateFromRemote(&remote[i]))
+	}
+
+	return Resolve(installed, candidates, requirements())
+}
+
+// FetchPackages resolves packages like ResolvePackages and downloads every
+// package the resolver selects from a repository. It returns the paths of
+// the downloaded archives.
+func FetchPackages(env *Env, local []Candidate, names []string) ([]string, error) {
+	resolution, err := ResolvePackages(env, local, names)
+	if err != nil {
+		return nil, err
+	}
+
+	var downloaded []string
+
+	for _, candidate := range resolution.Packages {
+		if candidate.Remote == nil {
+			continue
+		}
+
+		path, err := DownloadPackage(env, *candidate.Remote)
+		if err != nil {
+			return nil, err
+		}
+
+		downloaded = append(downloaded, path)
+	}
+
+	return downloaded, nil
+}
+
+// SplitDependency splits a "name@constraint" string. The constraint is empty
+// when none was given.
+func SplitDependency(dependency string) (string, string) {
+	splitdep := strings.SplitN(dependency, "@", 2)
+	if len(splitdep) == 1 {
+		return splitdep[0], ""
+	}
+
+	return splitdep[0], splitdep[1]
+}
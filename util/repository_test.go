@@ -0,0 +1,327 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRepository builds a repository directory holding one package,
+// hello@1.0.0 at main/hello-1.0.0.apkg, and its index.
+func testRepository(t *testing.T) string {
+	t.Helper()
+
+	repository := t.TempDir()
+
+	archive := buildTestPackage(t, t.TempDir(), "hello", `spec = 1
+[package]
+name = "hello"
+version = "1.0.0"
+description = "Says hello"
+[files]
+"bin/hello" = "hello"
+`, map[string]string{"hello": "hello"})
+
+	if err := os.MkdirAll(filepath.Join(repository, "main"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(archive, filepath.Join(repository, "main", "hello-1.0.0.apkg")); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := GenerateIndex(repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteIndex(repository, index); err != nil {
+		t.Fatal(err)
+	}
+
+	return repository
+}
+
+func TestFetchIndex(t *testing.T) {
+	directory := testRepository(t)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(directory)))
+	defer server.Close()
+
+	hash, err := HashFile(filepath.Join(directory, "main", "hello-1.0.0.apkg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		url     string
+		wantErr string
+	}{
+		{name: "http", url: server.URL},
+		{name: "http with trailing slash", url: server.URL + "/"},
+		{name: "file url", url: "file://" + directory},
+		{name: "plain path", url: directory},
+		{name: "missing http index", url: server.URL + "/nothere", wantErr: "404 Not Found"},
+		{name: "missing directory", url: filepath.Join(directory, "nothere"), wantErr: "no such file or directory"},
+		{name: "unsupported scheme", url: "ftp://example.com/repo", wantErr: "Unsupported repository URL scheme ftp"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repository := Repository{Name: "main", URL: test.url}
+
+			index, err := FetchIndex(context.Background(), repository)
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(index.Packages) != 1 {
+				t.Fatalf("got %d packages, want 1", len(index.Packages))
+			}
+
+			pkg := index.Packages[0]
+
+			if pkg.Name != "hello" || pkg.Version != "1.0.0" || pkg.Path != "main/hello-1.0.0.apkg" || pkg.Hash != hash {
+				t.Fatalf("got %+v, want hello@1.0.0 at main/hello-1.0.0.apkg with hash %s", pkg, hash)
+			}
+
+			env := testEnv(t)
+
+			downloaded, err := DownloadPackage(env, RemotePackage{Repository: repository, IndexPackage: pkg})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, err := HashFile(downloaded); err != nil || got != hash {
+				t.Errorf("downloaded archive has hash %s (%v), want %s", got, err, hash)
+			}
+		})
+	}
+}
+
+func TestDownloadPackageHashMismatch(t *testing.T) {
+	directory := testRepository(t)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(directory)))
+	defer server.Close()
+
+	index, err := ReadIndex(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := index.Packages[0]
+	wrong := strings.Repeat("0", len(published.Hash))
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{name: "http", url: server.URL},
+		{name: "file url", url: "file://" + directory},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := testEnv(t)
+
+			pkg := RemotePackage{Repository: Repository{Name: "main", URL: test.url}, IndexPackage: published}
+			pkg.Hash = wrong
+
+			_, err := DownloadPackage(env, pkg)
+
+			want := "Hash mismatch for hello@1.0.0: expected " + wrong + ", got " + published.Hash
+			if err == nil || err.Error() != want {
+				t.Fatalf("got error %v, want %q", err, want)
+			}
+
+			entries, err := os.ReadDir(filepath.Join(env.Root, "cache"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(entries) != 0 {
+				t.Errorf("the rejected download was left in the cache as %s", entries[0].Name())
+			}
+		})
+	}
+}
+
+func TestDownloadPackageReplacesCorruptCache(t *testing.T) {
+	directory := testRepository(t)
+
+	index, err := ReadIndex(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkg := RemotePackage{Repository: Repository{Name: "main", URL: directory}, IndexPackage: index.Packages[0]}
+	env := testEnv(t)
+
+	cached := filepath.Join(env.Root, "cache", pkg.Hash+".apkg")
+
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(cached, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	downloaded, err := DownloadPackage(env, pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash, err := HashFile(downloaded); err != nil || hash != pkg.Hash {
+		t.Errorf("cached archive has hash %s (%v), want %s", hash, err, pkg.Hash)
+	}
+}
+
+func TestFetchPackagesOnlyFetchesIndexesWhenNeeded(t *testing.T) {
+	directory := testRepository(t)
+	dir := t.TempDir()
+
+	// A closed server stands in for a repository that can't be reached.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	standalone := buildTestPackage(t, dir, "standalone", `spec = 1
+[package]
+name = "standalone"
+version = "1.0.0"
+`, nil)
+
+	needsHello := buildTestPackage(t, dir, "greeter", `spec = 1
+[package]
+name = "greeter"
+version = "1.0.0"
+[dependencies]
+required = ["hello"]
+`, nil)
+
+	tests := []struct {
+		name         string
+		repositories []Repository
+		files        []string
+		names        []string
+		want         int
+		wantErr      string
+	}{
+		{
+			name:         "local file without dependencies",
+			repositories: []Repository{{Name: "down", URL: closed.URL}},
+			files:        []string{standalone},
+			want:         0,
+		},
+		{
+			name:         "local file with a dependency in a repository",
+			repositories: []Repository{{Name: "main", URL: directory}},
+			files:        []string{needsHello},
+			want:         1,
+		},
+		{
+			name:         "local file with a dependency and the repository down",
+			repositories: []Repository{{Name: "down", URL: closed.URL}},
+			files:        []string{needsHello},
+			wantErr:      "Couldn't fetch index for repository down",
+		},
+		{
+			name:         "names",
+			repositories: []Repository{{Name: "down", URL: closed.URL}},
+			names:        []string{"hello"},
+			wantErr:      "Couldn't fetch index for repository down",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := testEnv(t)
+
+			if err := WriteRepositories(env.Root, &RepositoryConfig{Repositories: test.repositories}); err != nil {
+				t.Fatal(err)
+			}
+
+			var local []Candidate
+			for _, file := range test.files {
+				pkg, err := InspectPackage(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				local = append(local, CandidateFromPackage(pkg, file))
+			}
+
+			downloaded, err := FetchPackages(env, local, test.names)
+
+			if test.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(downloaded) != test.want {
+				t.Errorf("downloaded %v, want %d archives", downloaded, test.want)
+			}
+		})
+	}
+}
+
+func TestRepositoriesRoundTrip(t *testing.T) {
+	root := t.TempDir()
+
+	if err := AddRepository(root, "main", "https://example.com/main"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddRepository(root, "local", "/srv/packages"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddRepository(root, "main", "https://example.com/other"); err == nil {
+		t.Error("added a second repository named main")
+	}
+
+	if err := RemoveRepository(root, "main"); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ReadRepositories(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Repositories) != 1 || config.Repositories[0] != (Repository{Name: "local", URL: "/srv/packages"}) {
+		t.Errorf("got repositories %v, want only local", config.Repositories)
+	}
+
+	// The file is replaced by a rename, leaving no temporary files behind.
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != "repositories.toml" {
+		t.Errorf("got %v in the root, want only repositories.toml", entries)
+	}
+}
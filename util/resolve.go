@@ -0,0 +1,469 @@
+package util
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+)
+
+// Candidate is one concrete version of a package that the resolver may
+// select. It is either already installed, a local package file, or an entry
+// from a repository index.
+type Candidate struct {
+	Name         string
+	Version      string
+	Dependencies Dependencies
+	Installed    bool
+	File         string
+	Remote       *RemotePackage
+
+	version *semver.Version
+}
+
+// Requirement is a constraint on a package name. From names the package that
+// introduced it, or is empty when the user asked for it directly.
+type Requirement struct {
+	Name       string
+	Constraint string
+	From       string
+
+	pin *Candidate
+}
+
+func (r Requirement) String() string {
+	if r.Constraint == "" {
+		return r.Name
+	}
+
+	return r.Name + "@" + r.Constraint
+}
+
+// Resolution is the set of packages chosen by the resolver that still have to
+// be installed, ordered so that every package comes after its dependencies,
+// together with the optional dependencies of those packages.
+type Resolution struct {
+	Packages []*Candidate
+	Optional []OptionalDependency
+}
+
+// OptionalDependency is an optional dependency of the package From. Version
+// is the version of the package of that name that is installed or selected
+// along with From, and is empty when there is none. Optional dependencies
+// never make the resolver pick a package, and one that isn't satisfied
+// doesn't stop From from being installed.
+type OptionalDependency struct {
+	From       string `toml:"from,omitempty" json:"from,omitempty"`
+	Name       string `toml:"name" json:"name"`
+	Constraint string `toml:"constraint,omitempty" json:"constraint,omitempty"`
+	Version    string `toml:"version,omitempty" json:"version,omitempty"`
+	Satisfied  bool   `toml:"satisfied" json:"satisfied"`
+}
+
+func (d OptionalDependency) String() string {
+	if d.Constraint == "" {
+		return d.Name
+	}
+
+	return d.Name + "@" + d.Constraint
+}
+
+// optionalDependencies checks the optional dependencies of a package against
+// the versions returned by version, which returns "" for packages that
+// aren't there.
+func optionalDependencies(from string, dependencies Dependencies, version func(name string) string) []OptionalDependency {
+	optional := []OptionalDependency{}
+
+	for _, dependency := range dependencies.Optional {
+		name, constraint := SplitDependency(dependency)
+		status := OptionalDependency{From: from, Name: name, Constraint: constraint, Version: version(name)}
+
+		if status.Version != "" {
+			status.Satisfied = checkConstraint(name, constraint, status.Version) == nil
+		}
+
+		optional = append(optional, status)
+	}
+
+	return optional
+}
+
+type resolver struct {
+	candidates map[string][]*Candidate
+	assigned   map[string]*Candidate
+	imposed    map[string][]Requirement
+	conflict   *resolveConflict
+}
+
+type resolveConflict struct {
+	depth        int
+	name         string
+	requirements []Requirement
+}
+
+func CandidateFromPackage(pkg *PackageRoot, file string) Candidate {
+	return Candidate{Name: pkg.Package.Name, Version: pkg.Package.Version, Dependencies: pkg.Dependencies, File: file}
+}
+
+func CandidateFromRemote(pkg *RemotePackage) Candidate {
+	return Candidate{Name: pkg.Name, Version: pkg.Version, Dependencies: pkg.Dependencies, Remote: pkg}
+}
+
+// PinRequirement requests exactly the given candidate, as when a package file
+// is passed on the command line.
+func PinRequirement(candidate *Candidate) Requirement {
+	return Requirement{Name: candidate.Name, Constraint: "=" + candidate.Version, pin: candidate}
+}
+
+// Resolve picks one version for every package reachable from the requested
+// requirements such that all dependency constraints hold. Installed packages
+// are fixed at their current version. Among the remaining candidates newer
+// versions are preferred, and local files win over repositories for the same
+// version. When no consistent selection exists the error names the package
+// and every constraint that could not be satisfied together.
+func Resolve(installed map[string]DBPackage, candidates []Candidate, requested []Requirement) (*Resolution, error) {
+	r := resolver{
+		candidates: make(map[string][]*Candidate),
+		assigned:   make(map[string]*Candidate),
+		imposed:    make(map[string][]Requirement),
+	}
+
+	for name, pkg := range installed {
+		candidate := &Candidate{Name: name, Version: pkg.Package.Version, Dependencies: pkg.Dependencies, Installed: true}
+		r.assigned[name] = candidate
+	}
+
+	for i := range candidates {
+		candidate := &candidates[i]
+
+		if _, ok := installed[candidate.Name]; ok {
+			continue
+		}
+
+		version, err := semver.NewVersion(candidate.Version)
+		if err != nil {
+			return nil, &ErrorString{S: "Invalid version " + candidate.Version + " for package " + candidate.Name}
+		}
+
+		candidate.version = version
+		r.candidates[candidate.Name] = append(r.candidates[candidate.Name], candidate)
+	}
+
+	for _, list := range r.candidates {
+		sort.SliceStable(list, func(i, j int) bool {
+			if !list[i].version.Equal(list[j].version) {
+				return list[i].version.GreaterThan(list[j].version)
+			}
+
+			return list[i].File != "" && list[j].File == ""
+		})
+	}
+
+	ok, err := r.solve(requested, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, r.conflictError()
+	}
+
+	resolution, err := r.order()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, candidate := range resolution.Packages {
+		resolution.Optional = append(resolution.Optional, optionalDependencies(candidate.Name+"@"+candidate.Version, candidate.Dependencies, func(name string) string {
+			if assigned, ok := r.assigned[name]; ok {
+				return assigned.Version
+			}
+
+			return ""
+		})...)
+	}
+
+	return resolution, nil
+}
+
+func (r *resolver) solve(queue []Requirement, depth int) (bool, error) {
+	if len(queue) == 0 {
+		return true, nil
+	}
+
+	requirement := queue[0]
+	rest := queue[1:]
+
+	r.imposed[requirement.Name] = append(r.imposed[requirement.Name], requirement)
+	defer func() {
+		r.imposed[requirement.Name] = r.imposed[requirement.Name][:len(r.imposed[requirement.Name])-1]
+	}()
+
+	if candidate, ok := r.assigned[requirement.Name]; ok {
+		satisfied, err := satisfies(candidate, requirement)
+		if err != nil {
+			return false, err
+		}
+
+		if !satisfied {
+			r.recordConflict(requirement.Name, depth)
+			return false, nil
+		}
+
+		return r.solve(rest, depth+1)
+	}
+
+	options := r.candidates[requirement.Name]
+	if requirement.pin != nil {
+		options = []*Candidate{requirement.pin}
+	}
+
+	for _, candidate := range options {
+		fits := true
+
+		for _, imposed := range r.imposed[requirement.Name] {
+			satisfied, err := satisfies(candidate, imposed)
+			if err != nil {
+				return false, err
+			}
+
+			if !satisfied {
+				fits = false
+				break
+			}
+		}
+
+		if !fits {
+			continue
+		}
+
+		r.assigned[requirement.Name] = candidate
+
+		next := append([]Requirement{}, rest...)
+		next = append(next, dependencyRequirements(candidate)...)
+
+		ok, err := r.solve(next, depth+1)
+		if err != nil {
+			return false, err
+		}
+
+		if ok {
+			return true, nil
+		}
+
+		delete(r.assigned, requirement.Name)
+	}
+
+	r.recordConflict(requirement.Name, depth)
+
+	return false, nil
+}
+
+// dependencyRequirements returns the requirements a candidate's required
+// dependencies impose. Optional dependencies impose none.
+func dependencyRequirements(candidate *Candidate) []Requirement {
+	from := candidate.Name + "@" + candidate.Version
+
+	var requirements []Requirement
+
+	for _, dependency := range candidate.Dependencies.Required {
+		name, constraint := SplitDependency(dependency)
+		requirements = append(requirements, Requirement{Name: name, Constraint: constraint, From: from})
+	}
+
+	return requirements
+}
+
+func satisfies(candidate *Candidate, requirement Requirement) (bool, error) {
+	if requirement.pin != nil && !candidate.Installed {
+		return candidate == requirement.pin, nil
+	}
+
+	if requirement.Constraint == "" {
+		return true, nil
+	}
+
+	c, err := semver.NewConstraint(requirement.Constraint)
+	if err != nil {
+		return false, &ErrorString{S: "Invalid version constraint " + requirement.String() + requiredBy(requirement)}
+	}
+
+	version := candidate.version
+	if version == nil {
+		version, err = semver.NewVersion(candidate.Version)
+		if err != nil {
+			return false, &ErrorString{S: "Invalid version " + candidate.Version + " for package " + candidate.Name}
+		}
+	}
+
+	return c.Check(version), nil
+}
+
+// recordConflict remembers the failure that got furthest into the search,
+// which is the one most likely to explain why resolution failed.
+func (r *resolver) recordConflict(name string, depth int) {
+	if r.conflict != nil && r.conflict.depth > depth {
+		return
+	}
+
+	r.conflict = &resolveConflict{
+		depth:        depth,
+		name:         name,
+		requirements: append([]Requirement{}, r.imposed[name]...),
+	}
+}
+
+func (r *resolver) conflictError() error {
+	conflict := r.conflict
+	if conflict == nil {
+		return &ErrorString{S: "Couldn't resolve dependencies"}
+	}
+
+	var available []string
+
+	if candidate, ok := r.assigned[conflict.name]; ok && candidate.Installed {
+		available = append(available, candidate.Version+" (installed)")
+	}
+
+	for _, candidate := range r.candidates[conflict.name] {
+		available = append(available, candidate.Version)
+	}
+
+	var lines []string
+
+	if len(available) == 0 {
+		lines = append(lines, "Dependency not found: "+conflict.name)
+	} else {
+		lines = append(lines, "No version of "+conflict.name+" satisfies all constraints")
+	}
+
+	for _, requirement := range conflict.requirements {
+		lines = append(lines, "  "+requirement.String()+requiredBy(requirement))
+	}
+
+	if len(available) != 0 {
+		lines = append(lines, "  available: "+strings.Join(available, ", "))
+	}
+
+	var constraints []string
+	for _, requirement := range conflict.requirements {
+		if requirement.Constraint != "" {
+			constraints = append(constraints, requirement.Constraint)
+		}
+	}
+
+	found := ""
+	if candidate, ok := r.assigned[conflict.name]; ok && candidate.Installed {
+		found = candidate.Version
+	}
+
+	return &ConstraintError{Package: conflict.name, Constraint: strings.Join(constraints, ", "), Found: found, Detail: strings.Join(lines, "\n")}
+}
+
+func requiredBy(requirement Requirement) string {
+	if requirement.From == "" {
+		return " (requested)"
+	}
+
+	return " (required by " + requirement.From + ")"
+}
+
+// order returns the assigned packages that are not installed yet with every
+// dependency placed before its dependents. Optional dependencies that were
+// selected anyway are placed before their dependents too, unless a cycle
+// gets in the way. Packages that require each other in a cycle can't be
+// ordered and fail with a CycleError.
+func (r *resolver) order() (*Resolution, error) {
+	var resolution Resolution
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+
+	state := make(map[string]int)
+	var stack []string
+
+	names := make([]string, 0, len(r.assigned))
+	for name := range r.assigned {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		candidate, ok := r.assigned[name]
+		if !ok || state[name] != 0 {
+			return nil
+		}
+
+		// Installed packages are already in place, whatever they depend on.
+		if candidate.Installed {
+			state[name] = visited
+			return nil
+		}
+
+		state[name] = visiting
+		stack = append(stack, name)
+
+		for _, requirement := range dependencyRequirements(candidate) {
+			if requirement.Name == name {
+				continue
+			}
+
+			if state[requirement.Name] == visiting {
+				for i := range stack {
+					if stack[i] == requirement.Name {
+						return &CycleError{Packages: append(append([]string{}, stack[i:]...), requirement.Name)}
+					}
+				}
+			}
+
+			if err := visit(requirement.Name); err != nil {
+				return err
+			}
+		}
+
+		for _, dependency := range candidate.Dependencies.Optional {
+			if name, _ := SplitDependency(dependency); !r.requires(name, candidate.Name, make(map[string]bool)) {
+				if err := visit(name); err != nil {
+					return err
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		resolution.Packages = append(resolution.Packages, candidate)
+
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return &resolution, nil
+}
+
+// requires reports whether the assigned package from requires name, directly
+// or through other assigned packages.
+func (r *resolver) requires(from string, name string, seen map[string]bool) bool {
+	candidate, ok := r.assigned[from]
+	if !ok || seen[from] {
+		return false
+	}
+
+	seen[from] = true
+
+	for _, requirement := range dependencyRequirements(candidate) {
+		if requirement.Name == name || r.requires(requirement.Name, name, seen) {
+			return true
+		}
+	}
+
+	return false
+}
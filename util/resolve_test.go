@@ -0,0 +1,139 @@
+package util
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func candidate(name string, version string, required ...string) Candidate {
+	return Candidate{Name: name, Version: version, Dependencies: Dependencies{Required: required}, File: name + "-" + version + ".apkg"}
+}
+
+func installedPackage(name string, version string, required ...string) DBPackage {
+	return DBPackage{Package: Package{Name: name, Version: version}, Dependencies: Dependencies{Required: required}}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name       string
+		installed  map[string]DBPackage
+		candidates []Candidate
+		requested  []string
+		want       []string
+		wantErr    string
+	}{
+		{
+			name:       "prefers the newest version",
+			candidates: []Candidate{candidate("a", "1.0.0"), candidate("a", "2.0.0"), candidate("a", "1.5.0")},
+			requested:  []string{"a"},
+			want:       []string{"a@2.0.0"},
+		},
+		{
+			name:       "honours requested constraints",
+			candidates: []Candidate{candidate("a", "1.0.0"), candidate("a", "2.0.0"), candidate("a", "1.5.0")},
+			requested:  []string{"a@^1.0"},
+			want:       []string{"a@1.5.0"},
+		},
+		{
+			name:       "orders dependencies first",
+			candidates: []Candidate{candidate("app", "1.0.0", "lib"), candidate("lib", "1.0.0", "core"), candidate("core", "1.0.0")},
+			requested:  []string{"app"},
+			want:       []string{"core@1.0.0", "lib@1.0.0", "app@1.0.0"},
+		},
+		{
+			name: "backtracks to an older version",
+			candidates: []Candidate{
+				candidate("x", "2.0.0", "z@^2.0"),
+				candidate("x", "1.0.0", "z@^1.0"),
+				candidate("y", "1.0.0", "z@^1.0"),
+				candidate("z", "2.0.0"),
+				candidate("z", "1.0.0"),
+			},
+			requested: []string{"x", "y"},
+			want:      []string{"z@1.0.0", "x@1.0.0", "y@1.0.0"},
+		},
+		{
+			name:       "leaves installed packages alone",
+			installed:  map[string]DBPackage{"lib": installedPackage("lib", "1.2.0")},
+			candidates: []Candidate{candidate("app", "1.0.0", "lib@^1.0"), candidate("lib", "1.3.0")},
+			requested:  []string{"app"},
+			want:       []string{"app@1.0.0"},
+		},
+		{
+			name:       "explains conflicting constraints",
+			installed:  map[string]DBPackage{"lib": installedPackage("lib", "1.2.0")},
+			candidates: []Candidate{candidate("app", "1.0.0", "lib@^2.0")},
+			requested:  []string{"app"},
+			wantErr:    "No version of lib satisfies all constraints\n  lib@^2.0 (required by app@1.0.0)\n  available: 1.2.0 (installed)",
+		},
+		{
+			name:       "reports missing dependencies",
+			candidates: []Candidate{candidate("app", "1.0.0", "nothere")},
+			requested:  []string{"app"},
+			wantErr:    "Dependency not found: nothere\n  nothere (required by app@1.0.0)",
+		},
+		{
+			name:       "rejects dependency cycles",
+			candidates: []Candidate{candidate("a", "1.0.0", "b"), candidate("b", "1.0.0", "a")},
+			requested:  []string{"a"},
+			wantErr:    "Dependency cycle: a -> b -> a",
+		},
+		{
+			name:       "ignores missing optional dependencies",
+			candidates: []Candidate{{Name: "app", Version: "1.0.0", Dependencies: Dependencies{Optional: []string{"opt@^2.0"}}}},
+			requested:  []string{"app"},
+			want:       []string{"app@1.0.0"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requested := make([]Requirement, len(test.requested))
+			for i, target := range test.requested {
+				name, constraint := SplitDependency(target)
+				requested[i] = Requirement{Name: name, Constraint: constraint}
+			}
+
+			resolution, err := Resolve(test.installed, test.candidates, requested)
+
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, candidate := range resolution.Packages {
+				got = append(got, candidate.Name+"@"+candidate.Version)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveErrorTypes(t *testing.T) {
+	_, err := Resolve(nil, []Candidate{candidate("app", "1.0.0", "lib@^2.0"), candidate("lib", "1.0.0")}, []Requirement{{Name: "app"}})
+
+	var constraint *ConstraintError
+	if !errors.As(err, &constraint) || constraint.Package != "lib" || constraint.Constraint != "^2.0" {
+		t.Errorf("got %#v, want a ConstraintError for lib@^2.0", err)
+	}
+
+	_, err = Resolve(nil, []Candidate{candidate("a", "1.0.0", "b"), candidate("b", "1.0.0", "c"), candidate("c", "1.0.0", "b")}, []Requirement{{Name: "a"}})
+
+	var cycle *CycleError
+	if !errors.As(err, &cycle) || strings.Join(cycle.Packages, " ") != "b c b" {
+		t.Errorf("got %#v, want a CycleError for b -> c -> b", err)
+	}
+}
@@ -0,0 +1,359 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Signature is a detached ed25519 signature over a package archive, stored
+// next to the archive with SignatureSuffix appended to its name. Key is the
+// fingerprint of the public key that made it.
+type Signature struct {
+	Key       string `toml:"key" json:"key"`
+	Signature string `toml:"signature" json:"signature"`
+}
+
+// Key is a public key in the keyring under the root.
+type Key struct {
+	Name        string
+	Fingerprint string
+	PublicKey   ed25519.PublicKey
+}
+
+type SignaturePolicy string
+
+const (
+	SignatureRequire SignaturePolicy = "require"
+	SignatureWarn    SignaturePolicy = "warn"
+	SignatureOff     SignaturePolicy = "off"
+)
+
+const SignatureSuffix = ".sig"
+
+// ParseSignaturePolicy checks a policy given on the command line.
+func ParseSignaturePolicy(policy string) (SignaturePolicy, error) {
+	switch SignaturePolicy(policy) {
+	case SignatureRequire, SignatureWarn, SignatureOff:
+		return SignaturePolicy(policy), nil
+	}
+
+	return "", &ErrorString{S: "Unknown signature policy " + policy + ", expected require, warn or off"}
+}
+
+// signedMessage is what gets signed for an archive: its sha256 hash with a
+// prefix, so that a signature can be checked against the hash published in a
+// repository index as well as against the archive itself.
+func signedMessage(hash string) []byte {
+	return []byte("apkg-signature-v1:" + hash)
+}
+
+// KeyFingerprint identifies a public key by the first 8 bytes of its sha256.
+func KeyFingerprint(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// GenerateKey writes a new private key to path and its public key to
+// path.pub, both base64 encoded.
+func GenerateKey(path string) (*Key, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, &ErrorString{S: path + " already exists"}
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(privateKey.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(path+".pub", []byte(base64.StdEncoding.EncodeToString(publicKey)+"\n"), 0644); err != nil {
+		return nil, err
+	}
+
+	return &Key{Fingerprint: KeyFingerprint(publicKey), PublicKey: publicKey}, nil
+}
+
+func readPrivateKey(path string) (ed25519.PrivateKey, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, &ErrorString{S: path + " is not an apkg private key"}
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func readPublicKey(path string) (ed25519.PublicKey, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, &ErrorString{S: path + " is not an apkg public key"}
+	}
+
+	return ed25519.PublicKey(publicKey), nil
+}
+
+// SignPackage signs an archive with the private key at keyPath and writes
+// the signature next to it.
+func SignPackage(archive string, keyPath string) (*Signature, error) {
+	privateKey, err := readPrivateKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := HashFile(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := Signature{
+		Key:       KeyFingerprint(privateKey.Public().(ed25519.PublicKey)),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, signedMessage(hash))),
+	}
+
+	if err := WriteSignature(archive, &signature); err != nil {
+		return nil, err
+	}
+
+	return &signature, nil
+}
+
+// ReadSignature reads the detached signature of an archive. It returns nil
+// without an error when the archive isn't signed.
+func ReadSignature(archive string) (*Signature, error) {
+	var signature Signature
+
+	if _, err := toml.DecodeFile(archive+SignatureSuffix, &signature); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &signature, nil
+}
+
+func WriteSignature(archive string, signature *Signature) error {
+	return writeFileAtomic(archive+SignatureSuffix, func(file *os.File) error {
+		return toml.NewEncoder(file).Encode(signature)
+	})
+}
+
+func keysPath(root string) string {
+	return filepath.Join(root, "keys")
+}
+
+// ListKeys returns the trusted keys in the keyring, sorted by name.
+func ListKeys(root string) ([]Key, error) {
+	entries, err := os.ReadDir(keysPath(root))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var keys []Key
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pub") {
+			continue
+		}
+
+		publicKey, err := readPublicKey(filepath.Join(keysPath(root), entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, Key{Name: strings.TrimSuffix(entry.Name(), ".pub"), Fingerprint: KeyFingerprint(publicKey), PublicKey: publicKey})
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+
+	return keys, nil
+}
+
+// AddKey adds the public key at path to the keyring under name.
+func AddKey(root string, name string, path string) (*Key, error) {
+	if err := checkKeyName(name); err != nil {
+		return nil, err
+	}
+
+	publicKey, err := readPublicKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := ListKeys(root)
+	if err != nil {
+		return nil, err
+	}
+
+	key := Key{Name: name, Fingerprint: KeyFingerprint(publicKey), PublicKey: publicKey}
+
+	for _, existing := range keys {
+		if existing.Name == name {
+			return nil, &ErrorString{S: "Key already exists with name " + name}
+		}
+
+		if existing.Fingerprint == key.Fingerprint {
+			return nil, &ErrorString{S: "Key " + key.Fingerprint + " is already trusted as " + existing.Name}
+		}
+	}
+
+	if err := os.MkdirAll(keysPath(root), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomic(filepath.Join(keysPath(root), name+".pub"), func(file *os.File) error {
+		_, err := file.WriteString(base64.StdEncoding.EncodeToString(publicKey) + "\n")
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// checkKeyName makes sure a key name is a plain file name in the keyring.
+func checkKeyName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return &ErrorString{S: "Invalid key name " + name}
+	}
+
+	return nil
+}
+
+// RemoveKey removes the key with the given name from the keyring.
+func RemoveKey(root string, name string) error {
+	if err := checkKeyName(name); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(keysPath(root), name+".pub")); err != nil {
+		if os.IsNotExist(err) {
+			return &NotFoundError{Kind: "Key", Name: name}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// VerifyPackageSignature checks the detached signature of an archive against
+// the keyring and returns the key that signed it.
+func VerifyPackageSignature(root string, archive string) (*Key, error) {
+	signature, err := ReadSignature(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	if signature == nil {
+		return nil, &ErrorString{S: "No signature found"}
+	}
+
+	hash, err := HashFile(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	return verifySignature(root, signature, hash)
+}
+
+func verifySignature(root string, signature *Signature, hash string) (*Key, error) {
+	keys, err := ListKeys(root)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(signature.Signature)
+	if err != nil {
+		return nil, &ErrorString{S: "Malformed signature: " + err.Error()}
+	}
+
+	for _, key := range keys {
+		if key.Fingerprint != signature.Key {
+			continue
+		}
+
+		if !ed25519.Verify(key.PublicKey, signedMessage(hash), raw) {
+			return nil, &ErrorString{S: "Bad signature from key " + key.Name + " (" + key.Fingerprint + ")"}
+		}
+
+		return &key, nil
+	}
+
+	return nil, &ErrorString{S: "Signed by untrusted key " + signature.Key}
+}
+
+// verifyArchiveSignature checks the detached signature of an archive
+// against the hash it was read with.
+func verifyArchiveSignature(root string, archive *Archive) (*Key, error) {
+	signature, err := ReadSignature(archive.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if signature == nil {
+		return nil, &ErrorString{S: "No signature found"}
+	}
+
+	return verifySignature(root, signature, archive.Hash)
+}
+
+// verifyRemoteSignature checks the signature a repository index publishes
+// for a package against the hash it publishes with it.
+func verifyRemoteSignature(root string, pkg *RemotePackage) (*Key, error) {
+	if pkg.Signature == nil {
+		return nil, &ErrorString{S: "No signature found"}
+	}
+
+	return verifySignature(root, pkg.Signature, pkg.Hash)
+}
+
+// CheckSignatures applies the signature policy to package archives before
+// any of them is extracted. With SignatureRequire every archive needs a valid
+// signature from a trusted key; with SignatureWarn problems are only logged.
+func CheckSignatures(env *Env, archives []*Archive, policy SignaturePolicy) error {
+	if policy == SignatureOff {
+		return nil
+	}
+
+	for _, archive := range archives {
+		if _, err := verifyArchiveSignature(env.Root, archive); err != nil {
+			if policy == SignatureRequire {
+				return &ErrorString{S: "Signature check failed for " + archive.Path + ": " + err.Error()}
+			}
+
+			env.warn("signature check failed for " + archive.Path + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
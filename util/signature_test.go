@@ -0,0 +1,57 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveKeyRejectsInvalidNames(t *testing.T) {
+	root := t.TempDir()
+	outside := filepath.Join(root, "x.pub")
+
+	if err := os.WriteFile(outside, []byte("not a key\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"", "../x", `..\x`, "sub/x", ".hidden"} {
+		if err := RemoveKey(root, name); err == nil || err.Error() != "Invalid key name "+name {
+			t.Errorf("RemoveKey(%q) returned %v, want an invalid key name error", name, err)
+		}
+	}
+
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("RemoveKey removed a file outside the keyring: %v", err)
+	}
+}
+
+func TestAddAndRemoveKey(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(t.TempDir(), "signing")
+
+	generated, err := GenerateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added, err := AddKey(root, "release", path+".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if added.Fingerprint != generated.Fingerprint {
+		t.Errorf("got fingerprint %s, want %s", added.Fingerprint, generated.Fingerprint)
+	}
+
+	if err := RemoveKey(root, "release"); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys, err := ListKeys(root); err != nil || len(keys) != 0 {
+		t.Errorf("got keys %v (%v) after removing release, want none", keys, err)
+	}
+
+	if _, ok := RemoveKey(root, "release").(*NotFoundError); !ok {
+		t.Errorf("removing release twice didn't fail with a NotFoundError")
+	}
+}
@@ -0,0 +1,567 @@
+package util
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Transaction records every change an install, remove or upgrade makes to
+// the root in a journal under <root>/journal, so that a failure, or a crash
+// detected by the next apkg run, can restore the root to its state from
+// before the transaction started. Stores scheduled for deletion are only
+// removed on commit, which lets rollback relink removed files from them.
+type Transaction struct {
+	Root string
+
+	env     *Env
+	journal *os.File
+	lock    sync.Mutex
+	done    bool
+
+	// dbLock serializes the database reads and writes of the packages a
+	// transaction installs in parallel, and hookLock their hooks, which
+	// share the terminal.
+	dbLock   sync.Mutex
+	hookLock sync.Mutex
+}
+
+type JournalEntry struct {
+	Op     string `json:"op"`
+	Path   string `json:"path,omitempty"`
+	Source string `json:"source,omitempty"`
+	Mode   uint32 `json:"mode,omitempty"`
+}
+
+const (
+	journalLink      = "link"
+	journalMkdir     = "mkdir"
+	journalUnlink    = "unlink"
+	journalRmdir     = "rmdir"
+	journalMoveAside = "moveaside"
+	journalChmod     = "chmod"
+	journalStore     = "store"
+	journalDropStore = "dropstore"
+	journalNoDB      = "nodb"
+	journalCommit    = "commit"
+)
+
+func journalPath(root string) string {
+	return filepath.Join(root, "journal")
+}
+
+func BeginTransaction(env *Env) (*Transaction, error) {
+	root := env.Root
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := RecoverTransaction(root); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(journalPath(root), 0755); err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(filepath.Join(journalPath(root), "journal"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &Transaction{Root: root, env: env, journal: journal}
+
+	if err := copyFile(filepath.Join(root, "db.toml"), filepath.Join(journalPath(root), "db.toml")); err != nil {
+		if !os.IsNotExist(err) {
+			tx.abandon()
+			return nil, err
+		}
+
+		if err := tx.record(JournalEntry{Op: journalNoDB}); err != nil {
+			tx.abandon()
+			return nil, err
+		}
+	}
+
+	if err := journal.Sync(); err != nil {
+		tx.abandon()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// record appends entry to the journal and syncs it, so that the entry is on
+// disk before the change it describes is made and a crash in between can
+// always be rolled back.
+func (tx *Transaction) record(entry JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.journal.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return tx.journal.Sync()
+}
+
+func (tx *Transaction) abandon() {
+	tx.journal.Close()
+	os.RemoveAll(journalPath(tx.Root))
+}
+
+// RunTransaction runs fn inside a new transaction, committing it when fn
+// succeeds and rolling it back when fn fails.
+func RunTransaction(env *Env, fn func(tx *Transaction) error) error {
+	tx, err := BeginTransaction(env)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return &RollbackError{Err: err, Rollback: rollbackErr}
+		}
+
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Link hardlinks oldname to newname and records the new path.
+func (tx *Transaction) Link(oldname string, newname string) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	if _, err := os.Lstat(newname); err == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+
+	if err := tx.record(JournalEntry{Op: journalLink, Path: newname}); err != nil {
+		return err
+	}
+
+	return os.Link(oldname, newname)
+}
+
+// MkdirAll creates path and any missing parents, recording each directory it
+// creates so that rollback can remove them again.
+func (tx *Transaction) MkdirAll(path string, perm os.FileMode) error {
+	_, err := tx.mkdirAll(path, perm)
+	return err
+}
+
+// mkdirAll is MkdirAll, returning the directories it created, parents first.
+func (tx *Transaction) mkdirAll(path string, perm os.FileMode) ([]string, error) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	var missing []string
+
+	for current := path; ; current = filepath.Dir(current) {
+		if _, err := os.Lstat(current); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		missing = append(missing, current)
+
+		if filepath.Dir(current) == current {
+			break
+		}
+	}
+
+	var created []string
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := tx.record(JournalEntry{Op: journalMkdir, Path: missing[i]}); err != nil {
+			return created, err
+		}
+
+		if err := os.Mkdir(missing[i], perm); err != nil && !os.IsExist(err) {
+			return created, err
+		}
+
+		created = append(created, missing[i])
+	}
+
+	return created, nil
+}
+
+// Remove deletes a linked file whose contents live at source in a store.
+// Rollback relinks it from there.
+func (tx *Transaction) Remove(path string, source string) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	if err := tx.record(JournalEntry{Op: journalUnlink, Path: path, Source: source}); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// RemoveDir removes an empty directory, leaving it in place when something
+// else still lives in it. Rollback recreates it with its old permissions.
+func (tx *Transaction) RemoveDir(path string) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if entries, err := os.ReadDir(path); err != nil || len(entries) != 0 {
+		return err
+	}
+
+	if err := tx.record(JournalEntry{Op: journalRmdir, Path: path, Mode: uint32(info.Mode().Perm())}); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// MoveAside moves a file that is in the way into the journal directory.
+// Rollback moves it back, commit deletes it.
+func (tx *Transaction) MoveAside(path string) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	if err := os.MkdirAll(filepath.Join(journalPath(tx.Root), "aside"), 0755); err != nil {
+		return err
+	}
+
+	aside, err := os.MkdirTemp(filepath.Join(journalPath(tx.Root), "aside"), "")
+	if err != nil {
+		return err
+	}
+
+	backup := filepath.Join(aside, filepath.Base(path))
+
+	if err := tx.record(JournalEntry{Op: journalMoveAside, Path: path, Source: backup}); err != nil {
+		return err
+	}
+
+	return os.Rename(path, backup)
+}
+
+// Chmod changes the mode of path, recording the old mode for rollback.
+func (tx *Transaction) Chmod(path string, mode os.FileMode) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.record(JournalEntry{Op: journalChmod, Path: path, Mode: uint32(info.Mode().Perm())}); err != nil {
+		return err
+	}
+
+	return os.Chmod(path, mode)
+}
+
+// CreateStore creates a package store directory that is removed again on
+// rollback.
+func (tx *Transaction) CreateStore(path string) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	if err := tx.record(JournalEntry{Op: journalStore, Path: path}); err != nil {
+		return err
+	}
+
+	return os.MkdirAll(path, 0755)
+}
+
+// CreateTempStore creates a uniquely named store directory inside parent for
+// extracting a package whose hash isn't known yet. Like a store created by
+// CreateStore, it is removed again on rollback.
+func (tx *Transaction) CreateTempStore(parent string) (string, error) {
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+
+	for {
+		suffix := make([]byte, 8)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+
+		path := filepath.Join(parent, ".extract-"+hex.EncodeToString(suffix))
+
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			return path, tx.CreateStore(path)
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+// RenameStore moves a store directory created during the transaction to its
+// final path, which is removed again on rollback.
+func (tx *Transaction) RenameStore(from string, to string) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	if _, err := os.Lstat(to); err == nil {
+		return &ErrorString{S: "Package store already exists: " + to}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := tx.record(JournalEntry{Op: journalStore, Path: to}); err != nil {
+		return err
+	}
+
+	return os.Rename(from, to)
+}
+
+// DropStore schedules a package store directory for removal on commit.
+func (tx *Transaction) DropStore(path string) error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	return tx.record(JournalEntry{Op: journalDropStore, Path: path})
+}
+
+// WriteDatabase replaces the database like WriteDatabase, without rotating
+// the backups: a transaction rotates them once, when it commits, however
+// often it writes the database.
+func (tx *Transaction) WriteDatabase(db *Database) error {
+	return writeDatabase(tx.Root, db, false)
+}
+
+// Commit makes the transaction permanent and removes the stores that were
+// dropped during it. The database from before the transaction becomes the
+// newest backup, unless the transaction left it unchanged.
+func (tx *Transaction) Commit() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	if tx.done {
+		return nil
+	}
+
+	current, err := os.ReadFile(databasePath(tx.Root, 0))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := rotateDatabase(tx.Root, filepath.Join(journalPath(tx.Root), "db.toml"), current); err != nil {
+		return err
+	}
+
+	if err := syncDir(tx.Root); err != nil {
+		return err
+	}
+
+	if err := tx.record(JournalEntry{Op: journalCommit}); err != nil {
+		return err
+	}
+
+	tx.journal.Close()
+	tx.done = true
+
+	return finishTransaction(tx.Root)
+}
+
+// Rollback undoes every change recorded in the journal and restores the
+// database. It does nothing once the transaction has been committed, so it
+// can be deferred right after BeginTransaction.
+func (tx *Transaction) Rollback() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	if tx.done {
+		return nil
+	}
+
+	tx.journal.Close()
+	tx.done = true
+
+	return rollbackTransaction(tx.Root)
+}
+
+// RecoverTransaction completes or rolls back a transaction left behind by an
+// apkg process that died before committing or rolling back.
+func RecoverTransaction(root string) error {
+	entries, err := readJournal(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// A crash before the journal was created leaves at most an empty
+			// journal directory behind, and nothing was changed yet.
+			return os.RemoveAll(journalPath(root))
+		}
+
+		return err
+	}
+
+	if len(entries) != 0 && entries[len(entries)-1].Op == journalCommit {
+		return finishTransaction(root)
+	}
+
+	return rollbackTransaction(root)
+}
+
+func readJournal(root string) ([]JournalEntry, error) {
+	file, err := os.Open(filepath.Join(journalPath(root), "journal"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []JournalEntry
+
+	reader := bufio.NewReader(file)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			// A line without a newline was torn by a crash while it was being
+			// written; the change it describes never happened.
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var entry JournalEntry
+
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, &ErrorString{S: "Corrupt transaction journal: " + err.Error()}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func finishTransaction(root string) error {
+	entries, err := readJournal(root)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Op == journalDropStore {
+			if err := os.RemoveAll(entry.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return os.RemoveAll(journalPath(root))
+}
+
+func rollbackTransaction(root string) error {
+	entries, err := readJournal(root)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	restoreDB := true
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+
+		switch entry.Op {
+		case journalLink:
+			if err := os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+				failures = append(failures, err.Error())
+			}
+		case journalMkdir:
+			// Directories that are not empty were populated by something
+			// outside of this transaction and are left alone.
+			os.Remove(entry.Path)
+		case journalUnlink:
+			if _, err := os.Lstat(entry.Path); os.IsNotExist(err) {
+				if err := os.Link(entry.Source, entry.Path); err != nil {
+					failures = append(failures, err.Error())
+				}
+			}
+		case journalRmdir:
+			if err := os.Mkdir(entry.Path, os.FileMode(entry.Mode)); err != nil && !os.IsExist(err) {
+				failures = append(failures, err.Error())
+			}
+		case journalMoveAside:
+			if _, err := os.Lstat(entry.Source); err == nil {
+				if err := os.Rename(entry.Source, entry.Path); err != nil {
+					failures = append(failures, err.Error())
+				}
+			}
+		case journalChmod:
+			if err := os.Chmod(entry.Path, os.FileMode(entry.Mode)); err != nil && !os.IsNotExist(err) {
+				failures = append(failures, err.Error())
+			}
+		case journalStore:
+			if err := os.RemoveAll(entry.Path); err != nil {
+				failures = append(failures, err.Error())
+			}
+		case journalNoDB:
+			restoreDB = false
+
+			if err := os.Remove(filepath.Join(root, "db.toml")); err != nil && !os.IsNotExist(err) {
+				failures = append(failures, err.Error())
+			}
+		}
+	}
+
+	if restoreDB {
+		if err := os.Rename(filepath.Join(journalPath(root), "db.toml"), filepath.Join(root, "db.toml")); err != nil && !os.IsNotExist(err) {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) != 0 {
+		sort.Strings(failures)
+		return &ErrorString{S: "Rollback incomplete, journal kept in " + journalPath(root) + ":\n" + strings.Join(failures, "\n")}
+	}
+
+	return os.RemoveAll(journalPath(root))
+}
+
+func copyFile(source string, target string) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(output, input); err != nil {
+		output.Close()
+		return err
+	}
+
+	if err := output.Sync(); err != nil {
+		output.Close()
+		return err
+	}
+
+	return output.Close()
+}
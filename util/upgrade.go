@@ -0,0 +1,509 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Masterminds/semver"
+)
+
+// CheckUpgrade verifies that replacing an installed package with pkg keeps
+// every required dependency constraint in the database satisfied, both those
+// of pkg itself and those of the installed packages that depend on it.
+// Optional dependencies are left to upgradeOptional.
+func CheckUpgrade(db *Database, pkg *PackageRoot) error {
+	return checkUpgrade(db, pkg, nil)
+}
+
+// checkUpgrade is CheckUpgrade for a package upgraded along with the
+// packages in pending, which are upgraded later in the same transaction.
+// Their constraints are checked when they are upgraded.
+func checkUpgrade(db *Database, pkg *PackageRoot, pending map[string]bool) error {
+	name := pkg.Package.Name
+
+	current, ok := db.Packages[name]
+	if !ok {
+		return &NotFoundError{Kind: "Package", Name: name}
+	}
+
+	newVersion, err := semver.NewVersion(pkg.Package.Version)
+	if err != nil {
+		return err
+	}
+
+	oldVersion, err := semver.NewVersion(current.Package.Version)
+	if err != nil {
+		return err
+	}
+
+	if newVersion.LessThan(oldVersion) {
+		return &ErrorString{S: "Refusing to downgrade " + name + " from " + current.Package.Version + " to " + pkg.Package.Version}
+	}
+
+	for _, dependency := range pkg.Dependencies.Required {
+		depName, constraint := SplitDependency(dependency)
+
+		if depName == name {
+			continue
+		}
+
+		installed, ok := db.Packages[depName]
+		if !ok {
+			return &ConstraintError{Package: depName, Constraint: constraint}
+		}
+
+		if err := checkConstraint(depName, constraint, installed.Package.Version); err != nil {
+			return err
+		}
+	}
+
+	for dependentName, dependent := range db.Packages {
+		if dependentName == name || pending[dependentName] {
+			continue
+		}
+
+		for _, dependency := range dependent.Dependencies.Required {
+			depName, constraint := SplitDependency(dependency)
+
+			if depName != name {
+				continue
+			}
+
+			if err := checkConstraint(depName, constraint, pkg.Package.Version); err != nil {
+				return &ConstraintError{Package: name, Constraint: constraint, Found: pkg.Package.Version, Detail: "Upgrading " + name + " to " + pkg.Package.Version + " would break " + dependentName + ": " + err.Error()}
+			}
+		}
+	}
+
+	return nil
+}
+
+// upgradeOptional checks the optional dependencies of pkg, and those of the
+// installed packages on it, as they would be after upgrading to pkg.
+func upgradeOptional(db *Database, pkg *PackageRoot) []OptionalDependency {
+	name := pkg.Package.Name
+
+	version := func(depName string) string {
+		if depName == name {
+			return pkg.Package.Version
+		}
+
+		return db.Packages[depName].Package.Version
+	}
+
+	optional := optionalDependencies(name+"@"+pkg.Package.Version, pkg.Dependencies, version)
+
+	names := make([]string, 0, len(db.Packages))
+	for dependentName := range db.Packages {
+		names = append(names, dependentName)
+	}
+
+	sort.Strings(names)
+
+	for _, dependentName := range names {
+		if dependentName == name {
+			continue
+		}
+
+		dependent := db.Packages[dependentName]
+
+		for _, dependency := range optionalDependencies(dependentName+"@"+dependent.Package.Version, dependent.Dependencies, version) {
+			if dependency.Name == name {
+				optional = append(optional, dependency)
+			}
+		}
+	}
+
+	return optional
+}
+
+func checkConstraint(name string, constraint string, version string) error {
+	if constraint == "" {
+		return nil
+	}
+
+	depVersion, err := semver.NewVersion(version)
+	if err != nil {
+		return err
+	}
+
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return err
+	}
+
+	if !c.Check(depVersion) {
+		return &ConstraintError{Package: name, Constraint: constraint, Found: version}
+	}
+
+	return nil
+}
+
+// Upgrade replaces an installed package with the version in packageFile. The
+// new version is extracted next to the old one, the linked files are swapped
+// over and the database entry is replaced in a single write, all inside one
+// transaction so that a failure at any point restores the old version. The new
+// package's preupgrade and postupgrade hooks run around the swap, falling
+// back to its preinstall and postinstall hooks; the old package's remove
+// hooks are not run. Like InstallMultiple, it reads the archive once.
+func Upgrade(env *Env, packageFile string, options InstallOptions) error {
+	return UpgradeMultiple(env, nil, []string{packageFile}, options)
+}
+
+// UpgradeMultiple installs the package archives in dependencies, recorded as
+// installed as dependencies, and then upgrades installed packages to the
+// archives in upgrades, each like Upgrade, all in one transaction. A package
+// is upgraded after the packages of the batch it depends on.
+func UpgradeMultiple(env *Env, dependencies []string, upgrades []string, options InstallOptions) error {
+	if err := os.MkdirAll(env.Root, 0755); err != nil {
+		return err
+	}
+
+	return RunTransaction(env, func(tx *Transaction) error {
+		if len(dependencies) != 0 {
+			if err := installArchives(tx, dependencies, nil, options); err != nil {
+				return err
+			}
+		}
+
+		archives, err := ExtractArchives(tx, upgrades, options.Extract)
+		if err != nil {
+			return err
+		}
+
+		if err := CheckSignatures(env, archives, options.Signatures); err != nil {
+			return err
+		}
+
+		ordered, err := upgradeOrder(archives)
+		if err != nil {
+			return err
+		}
+
+		pending := make(map[string]bool)
+		for _, archive := range ordered {
+			pending[archive.Package.Package.Name] = true
+		}
+
+		for _, archive := range ordered {
+			if err := env.cancelled(); err != nil {
+				return err
+			}
+
+			delete(pending, archive.Package.Package.Name)
+
+			if err := upgradeArchive(tx, archive, pending); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// upgradeOrder orders a batch of archives to upgrade to so that every
+// package comes after the packages of the batch it requires or optionally
+// depends on. It fails with a CycleError when required dependencies form a
+// cycle; optional ones that would close a cycle don't affect the order.
+func upgradeOrder(archives []*Archive) ([]*Archive, error) {
+	byName := make(map[string]*Archive)
+	for _, archive := range archives {
+		name := archive.Package.Package.Name
+
+		if _, ok := byName[name]; ok {
+			return nil, &ErrorString{S: "More than one version of " + name + " to upgrade to"}
+		}
+
+		byName[name] = archive
+	}
+
+	var ordered []*Archive
+	state := make(map[string]int)
+	var stack []string
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		state[name] = visiting
+		stack = append(stack, name)
+
+		pkg := byName[name].Package
+		dependencies := append(append([]string(nil), pkg.Dependencies.Required...), pkg.Dependencies.Optional...)
+
+		for i, dependency := range dependencies {
+			depName, _ := SplitDependency(dependency)
+
+			if _, ok := byName[depName]; !ok || depName == name || state[depName] == visited {
+				continue
+			}
+
+			if state[depName] == visiting {
+				if i >= len(pkg.Dependencies.Required) {
+					continue
+				}
+
+				for j := range stack {
+					if stack[j] == depName {
+						return &CycleError{Packages: append(append([]string(nil), stack[j:]...), depName)}
+					}
+				}
+			}
+
+			if err := visit(depName); err != nil {
+				return err
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		ordered = append(ordered, byName[name])
+
+		return nil
+	}
+
+	for _, archive := range archives {
+		if state[archive.Package.Package.Name] == 0 {
+			if err := visit(archive.Package.Package.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ordered, nil
+}
+
+// upgradeArchive replaces the installed version of the package in an archive
+// extracted by ExtractArchive. pending are the packages the same transaction
+// upgrades after this one.
+func upgradeArchive(tx *Transaction, archive *Archive, pending map[string]bool) error {
+	root := tx.Root
+	env := tx.env
+
+	pkg := archive.Package
+	stringHash := archive.Hash
+
+	db, err := ReadDatabase(env)
+	if err != nil {
+		return err
+	}
+
+	if err := checkUpgrade(db, pkg, pending); err != nil {
+		return err
+	}
+
+	reportOptional(env, upgradeOptional(db, pkg))
+
+	if err := CheckPackageConflicts(root, db, []*Archive{archive}); err != nil {
+		return err
+	}
+
+	oldHash := db.Packages[pkg.Package.Name].Hash
+	oldDirs := db.Packages[pkg.Package.Name].Dirs
+
+	oldFiles, err := installedFiles(root, db.Packages[pkg.Package.Name])
+	if err != nil {
+		return err
+	}
+
+	if oldHash == stringHash {
+		return &AlreadyInstalledError{Name: pkg.Package.Name, Version: pkg.Package.Version}
+	}
+
+	oldPath := filepath.Join(root, "packages", oldHash)
+	installationPath := filepath.Join(root, "packages", stringHash)
+
+	preupgrade, postupgrade := pkg.Hooks.Preupgrade, pkg.Hooks.Postupgrade
+	if preupgrade == "" {
+		preupgrade = pkg.Hooks.Preinstall
+	}
+
+	if postupgrade == "" {
+		postupgrade = pkg.Hooks.Postinstall
+	}
+
+	if err := tx.RenameStore(archive.store, installationPath); err != nil {
+		return err
+	}
+
+	if err := tx.RunHook(installationPath, "preupgrade", preupgrade); err != nil {
+		return err
+	}
+
+	if err := RemoveFiles(tx, oldPath, oldFiles, oldDirs); err != nil {
+		return err
+	}
+
+	files, err := ScanFiles(installationPath, pkg)
+	if err != nil {
+		return err
+	}
+
+	if err := replaceFiles(tx, pkg, files); err != nil {
+		return err
+	}
+
+	dirs, err := InstallFiles(tx, installationPath, files)
+	if err != nil {
+		return err
+	}
+
+	dirs = keptDirs(root, oldDirs, dirs)
+
+	if err := tx.DropStore(oldPath); err != nil {
+		return err
+	}
+
+	db, err = ReadDatabase(env)
+	if err != nil {
+		return err
+	}
+
+	db.Packages[pkg.Package.Name] = DBPackage{Hash: stringHash, Reason: db.Packages[pkg.Package.Name].Reason, Dependencies: pkg.Dependencies, Package: pkg.Package, Files: files, Dirs: dirs}
+
+	if err := tx.WriteDatabase(db); err != nil {
+		return err
+	}
+
+	return tx.RunHook(installationPath, "postupgrade", postupgrade)
+}
+
+// keptDirs adds the directories the old version of a package created that
+// are still there, because other packages have files in them, to the ones
+// the new version created, so that they are still pruned once they are
+// empty.
+func keptDirs(root string, oldDirs []string, dirs []string) []string {
+	owned := make(map[string]bool)
+	for _, dir := range dirs {
+		owned[dir] = true
+	}
+
+	for _, dir := range oldDirs {
+		if owned[dir] {
+			continue
+		}
+
+		if info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(dir))); err == nil && info.IsDir() {
+			dirs = append(dirs, dir)
+			owned[dir] = true
+		}
+	}
+
+	return dirs
+}
+
+// FetchUpgrades looks up the newest repository version of each named package
+// that still satisfies the installed packages depending on it. It returns the
+// archives of dependencies that have to be installed first, and the archives
+// to upgrade to. Packages without a newer version are skipped; when names is
+// empty every installed package is considered.
+func FetchUpgrades(env *Env, names []string) ([]string, []string, error) {
+	installed, err := ListInstalled(env)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	all := len(names) == 0
+	if all {
+		for name := range installed {
+			names = append(names, name)
+		}
+	}
+
+	remote, err := FetchRemotePackages(env)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var dependencies []string
+	var upgrades []string
+	seen := make(map[string]bool)
+
+	for _, target := range names {
+		name, constraint := SplitDependency(target)
+
+		current, ok := installed[name]
+		if !ok {
+			return nil, nil, &NotFoundError{Kind: "Package", Name: name}
+		}
+
+		if all && !hasRemote(remote, name) {
+			continue
+		}
+
+		others := make(map[string]DBPackage)
+		requested := []Requirement{{Name: name, Constraint: constraint}}
+
+		for otherName, other := range installed {
+			if otherName == name {
+				continue
+			}
+
+			others[otherName] = other
+
+			for _, requirement := range dependencyRequirements(&Candidate{Name: otherName, Version: other.Package.Version, Dependencies: other.Dependencies}) {
+				if requirement.Name == name {
+					requested = append(requested, requirement)
+				}
+			}
+		}
+
+		candidates := make([]Candidate, 0, len(remote))
+		for i := range remote {
+			candidates = append(candidates, CandidateFromRemote(&remote[i]))
+		}
+
+		resolution, err := Resolve(others, candidates, requested)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		currentVersion, err := semver.NewVersion(current.Package.Version)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		newer := false
+
+		for _, candidate := range resolution.Packages {
+			if candidate.Name == name && candidate.version.GreaterThan(currentVersion) {
+				newer = true
+			}
+		}
+
+		if !newer {
+			continue
+		}
+
+		for _, candidate := range resolution.Packages {
+			path, err := DownloadPackage(env, *candidate.Remote)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if candidate.Name == name {
+				upgrades = append(upgrades, path)
+			} else if !seen[path] {
+				dependencies = append(dependencies, path)
+			}
+
+			seen[path] = true
+		}
+	}
+
+	return dependencies, upgrades, nil
+}
+
+func hasRemote(remote []RemotePackage, name string) bool {
+	for _, pkg := range remote {
+		if pkg.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
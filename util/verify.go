@@ -0,0 +1,148 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+const (
+	VerifyMissing  = "missing"
+	VerifyModified = "modified"
+	VerifyReplaced = "replaced"
+)
+
+// VerifyResult describes an installed path that no longer matches the
+// package's store directory.
+type VerifyResult struct {
+	Package string `toml:"package" json:"package"`
+	Path    string `toml:"path" json:"path"`
+	Status  string `toml:"status" json:"status"`
+	Detail  string `toml:"detail" json:"detail"`
+}
+
+// Verify compares the files of the named installed packages, or of every
+// installed package when names is empty, against their store directories.
+// A path is missing when it is gone from the root, replaced when it is no
+// longer the file linked from the store, and modified when its contents,
+// link target or mode differ from what was installed.
+func Verify(env *Env, names []string) ([]VerifyResult, error) {
+	root := env.Root
+
+	installed, err := ListInstalled(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		for name := range installed {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	results := []VerifyResult{}
+
+	for _, name := range names {
+		dbPackage, ok := installed[name]
+		if !ok {
+			return nil, &NotFoundError{Kind: "Package", Name: name}
+		}
+
+		files, err := installedFiles(root, dbPackage)
+		if err != nil {
+			return nil, err
+		}
+
+		installationPath := filepath.Join(root, "packages", dbPackage.Hash)
+
+		for _, file := range files {
+			status, detail, err := verifyFile(root, installationPath, file)
+			if err != nil {
+				return nil, err
+			}
+
+			if status != "" {
+				results = append(results, VerifyResult{Package: name, Path: file.Path, Status: status, Detail: detail})
+			}
+		}
+	}
+
+	return results, nil
+}
+
+func verifyFile(root string, installationPath string, file DBFile) (string, string, error) {
+	target := filepath.Join(root, filepath.FromSlash(file.Path))
+	source := filepath.Join(installationPath, filepath.FromSlash(file.Source))
+
+	info, err := os.Lstat(target)
+	if err != nil {
+		// A parent that was replaced by a file leaves nothing at the path
+		// either.
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			return VerifyMissing, "no such file", nil
+		}
+
+		return "", "", err
+	}
+
+	switch file.Type {
+	case FileTypeDir:
+		if !info.IsDir() {
+			return VerifyReplaced, "expected a directory", nil
+		}
+	case FileTypeSymlink:
+		if info.Mode()&os.ModeSymlink == 0 {
+			return VerifyReplaced, "expected a symlink", nil
+		}
+
+		expected, err := os.Readlink(source)
+		if err != nil {
+			return "", "", err
+		}
+
+		actual, err := os.Readlink(target)
+		if err != nil {
+			return "", "", err
+		}
+
+		if actual != expected {
+			return VerifyModified, "points to " + actual + ", expected " + expected, nil
+		}
+
+		return "", "", nil
+	default:
+		if !info.Mode().IsRegular() {
+			return VerifyReplaced, "expected a regular file", nil
+		}
+
+		hash, err := HashFile(target)
+		if err != nil {
+			return "", "", err
+		}
+
+		sourceInfo, err := os.Lstat(source)
+		linked := err == nil && os.SameFile(info, sourceInfo)
+
+		if file.Hash != "" && hash != file.Hash {
+			if linked {
+				return VerifyModified, "contents changed in place, including the store copy", nil
+			}
+
+			return VerifyModified, "contents differ", nil
+		}
+
+		if !linked {
+			return VerifyReplaced, "no longer linked to the package store", nil
+		}
+	}
+
+	if expected := file.FileMode().Perm(); info.Mode().Perm() != expected {
+		return VerifyModified, "mode " + formatMode(info.Mode().Perm()) + ", expected " + formatMode(expected), nil
+	}
+
+	return "", "", nil
+}
@@ -0,0 +1,141 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// installVerifyPackage installs a package with bin/tool and share/tool/data
+// into a new root.
+func installVerifyPackage(t *testing.T) *Env {
+	t.Helper()
+
+	file := buildTestPackage(t, t.TempDir(), "tool", `spec = 1
+[package]
+name = "tool"
+version = "1.0.0"
+[files]
+"bin/tool" = "tool"
+"share/tool" = "share"
+`, map[string]string{"tool": "#!/bin/sh\n", "share/data": "data"})
+
+	env := testEnv(t)
+
+	if err := InstallMultiple(env, []string{file}, []string{"tool"}, InstallOptions{Signatures: SignatureOff}); err != nil {
+		t.Fatal(err)
+	}
+
+	return env
+}
+
+// verifyDamage is a change made to an installed root, and what Verify
+// should report for it.
+var verifyDamage = []struct {
+	name   string
+	damage func(t *testing.T, root string)
+	want   []VerifyResult
+}{
+	{
+		name:   "untouched",
+		damage: func(t *testing.T, root string) {},
+		want:   []VerifyResult{},
+	},
+	{
+		name: "missing file",
+		damage: func(t *testing.T, root string) {
+			mustDo(t, os.Remove(filepath.Join(root, "bin", "tool")))
+		},
+		want: []VerifyResult{{Package: "tool", Path: "bin/tool", Status: VerifyMissing, Detail: "no such file"}},
+	},
+	{
+		name: "replaced by a copy",
+		damage: func(t *testing.T, root string) {
+			path := filepath.Join(root, "bin", "tool")
+			mustDo(t, os.Remove(path))
+			mustDo(t, os.WriteFile(path, []byte("#!/bin/sh\n"), 0644))
+		},
+		want: []VerifyResult{{Package: "tool", Path: "bin/tool", Status: VerifyReplaced, Detail: "no longer linked to the package store"}},
+	},
+	{
+		name: "replaced by other contents",
+		damage: func(t *testing.T, root string) {
+			path := filepath.Join(root, "share", "tool", "data")
+			mustDo(t, os.Remove(path))
+			mustDo(t, os.WriteFile(path, []byte("changed"), 0644))
+		},
+		want: []VerifyResult{{Package: "tool", Path: "share/tool/data", Status: VerifyModified, Detail: "contents differ"}},
+	},
+	{
+		name: "directory replaced",
+		damage: func(t *testing.T, root string) {
+			path := filepath.Join(root, "share", "tool")
+			mustDo(t, os.RemoveAll(path))
+			mustDo(t, os.WriteFile(path, nil, 0644))
+		},
+		want: []VerifyResult{
+			{Package: "tool", Path: "share/tool", Status: VerifyReplaced, Detail: "expected a directory"},
+			{Package: "tool", Path: "share/tool/data", Status: VerifyMissing, Detail: "no such file"},
+		},
+	},
+	{
+		name: "mode changed",
+		damage: func(t *testing.T, root string) {
+			mustDo(t, os.Chmod(filepath.Join(root, "share", "tool"), 0700))
+		},
+		want: []VerifyResult{{Package: "tool", Path: "share/tool", Status: VerifyModified, Detail: "mode 0700, expected 0755"}},
+	},
+}
+
+func mustDo(t *testing.T, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, test := range verifyDamage {
+		t.Run(test.name, func(t *testing.T) {
+			env := installVerifyPackage(t)
+			test.damage(t, env.Root)
+
+			results, err := Verify(env, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(results, test.want) {
+				t.Errorf("got %+v, want %+v", results, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyStoreModifiedInPlace(t *testing.T) {
+	env := installVerifyPackage(t)
+
+	// Writing through the hardlink changes the store copy as well.
+	mustDo(t, os.WriteFile(filepath.Join(env.Root, "bin", "tool"), []byte("changed"), 0644))
+
+	results, err := Verify(env, []string{"tool"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []VerifyResult{{Package: "tool", Path: "bin/tool", Status: VerifyModified, Detail: "contents changed in place, including the store copy"}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("got %+v, want %+v", results, want)
+	}
+}
+
+func TestVerifyUnknownPackage(t *testing.T) {
+	env := installVerifyPackage(t)
+
+	_, err := Verify(env, []string{"missing"})
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Errorf("got error %v, want a NotFoundError", err)
+	}
+}
@@ -0,0 +1,121 @@
+package util
+
+import (
+	"sort"
+)
+
+// DependencyLink is one package in a dependency chain. Optional is set when
+// the package before it in the chain only optionally depends on it.
+type DependencyLink struct {
+	Name     string `toml:"name" json:"name"`
+	Optional bool   `toml:"optional" json:"optional"`
+}
+
+// DependencyChain leads from an explicitly installed package down to the
+// package a WhyResult is about, each package depending on the next.
+type DependencyChain struct {
+	Links []DependencyLink `toml:"links" json:"links"`
+}
+
+// WhyResult explains why a package is installed: the chains of required and
+// optional dependencies that lead to it from explicitly installed packages,
+// and the installed packages that require it, directly or through other
+// packages, and would have to be removed along with it.
+type WhyResult struct {
+	Package string            `toml:"package" json:"package"`
+	Reason  string            `toml:"reason" json:"reason"`
+	Chains  []DependencyChain `toml:"chains" json:"chains"`
+	Breaks  []string          `toml:"breaks" json:"breaks"`
+}
+
+// Why works out why the named package is installed. A chain stops at the
+// first explicitly installed package on it, so an explicitly installed
+// package has the chain made of just itself. Packages that can only be
+// reached through dependency cycles aren't followed around the cycle.
+func Why(env *Env, name string) (*WhyResult, error) {
+	db, err := ReadDatabase(env)
+	if err != nil {
+		return nil, err
+	}
+
+	dbPackage, ok := db.Packages[name]
+	if !ok {
+		return nil, &NotFoundError{Kind: "Package", Name: name}
+	}
+
+	result := &WhyResult{Package: name, Reason: dbPackage.Reason, Chains: []DependencyChain{}, Breaks: transitiveDependents(db, []string{name})}
+
+	if result.Breaks == nil {
+		result.Breaks = []string{}
+	}
+
+	visiting := map[string]bool{name: true}
+
+	var walk func(path []DependencyLink)
+	walk = func(path []DependencyLink) {
+		current := path[0].Name
+
+		if db.Packages[current].Reason != ReasonDependency {
+			result.Chains = append(result.Chains, DependencyChain{Links: path})
+			return
+		}
+
+		for _, dependent := range reverseDependencies(db, current) {
+			if visiting[dependent.Name] {
+				continue
+			}
+
+			next := make([]DependencyLink, 0, len(path)+1)
+			next = append(next, DependencyLink{Name: dependent.Name})
+			next = append(next, path...)
+			next[1].Optional = dependent.Optional
+
+			visiting[dependent.Name] = true
+			walk(next)
+			visiting[dependent.Name] = false
+		}
+	}
+
+	walk([]DependencyLink{{Name: name}})
+
+	return result, nil
+}
+
+// reverseDependencies returns the installed packages that require or
+// optionally depend on name, sorted by name. Optional is set for those that
+// only optionally depend on it.
+func reverseDependencies(db *Database, name string) []DependencyLink {
+	var dependents []DependencyLink
+
+	for dependentName, pkg := range db.Packages {
+		if dependentName == name {
+			continue
+		}
+
+		link := DependencyLink{Name: dependentName, Optional: true}
+		found := false
+
+		for _, dependency := range pkg.Dependencies.Optional {
+			if depName, _ := SplitDependency(dependency); depName == name {
+				found = true
+			}
+		}
+
+		for _, dependency := range pkg.Dependencies.Required {
+			if depName, _ := SplitDependency(dependency); depName == name {
+				found = true
+				link.Optional = false
+			}
+		}
+
+		if found {
+			dependents = append(dependents, link)
+		}
+	}
+
+	sort.Slice(dependents, func(i, j int) bool {
+		return dependents[i].Name < dependents[j].Name
+	})
+
+	return dependents
+}
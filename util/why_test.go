@@ -0,0 +1,84 @@
+package util
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestWhy(t *testing.T) {
+	tool := installedPackage("tool", "1.0.0")
+	tool.Dependencies.Optional = []string{"core"}
+
+	env := testEnv(t)
+	testDatabase(t, env, []DBPackage{
+		installedPackage("app", "1.0.0", "lib"),
+		installedPackage("lib", "1.0.0", "core@^1.0"),
+		installedPackage("core", "1.0.0"),
+		tool,
+		// A cycle that only leads back into itself.
+		installedPackage("cyc1", "1.0.0", "core", "cyc2"),
+		installedPackage("cyc2", "1.0.0", "cyc1"),
+	}, "lib", "core", "cyc1", "cyc2")
+
+	tests := []struct {
+		name string
+		want *WhyResult
+	}{
+		{
+			name: "core",
+			want: &WhyResult{
+				Package: "core",
+				Reason:  ReasonDependency,
+				Chains: []DependencyChain{
+					{Links: []DependencyLink{{Name: "app"}, {Name: "lib"}, {Name: "core"}}},
+					{Links: []DependencyLink{{Name: "tool"}, {Name: "core", Optional: true}}},
+				},
+				Breaks: []string{"app", "cyc1", "cyc2", "lib"},
+			},
+		},
+		{
+			name: "app",
+			want: &WhyResult{
+				Package: "app",
+				Reason:  ReasonExplicit,
+				Chains:  []DependencyChain{{Links: []DependencyLink{{Name: "app"}}}},
+				Breaks:  []string{},
+			},
+		},
+		{
+			name: "cyc2",
+			want: &WhyResult{
+				Package: "cyc2",
+				Reason:  ReasonDependency,
+				Chains:  []DependencyChain{},
+				Breaks:  []string{"cyc1"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Why(env, test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWhyNotInstalled(t *testing.T) {
+	env := testEnv(t)
+	testDatabase(t, env, []DBPackage{installedPackage("app", "1.0.0")})
+
+	_, err := Why(env, "missing")
+
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) || notFound.Name != "missing" {
+		t.Fatalf("got error %v, want missing not found", err)
+	}
+}